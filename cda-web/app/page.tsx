@@ -57,9 +57,13 @@ interface Tab {
   isRenaming?: boolean
 }
 
+const BOOTSTRAP_PORT = 8079
+
 interface ServerStatus {
   port: string
   status: string
+  lastError?: string
+  statusChangedAt?: string
   tcpPort: number
   injectorStatus: {
     injected: boolean
@@ -67,11 +71,22 @@ interface ServerStatus {
     injectedAt: string
     features: Feature[]
   }
-  hwid: {
+  // Only reported to signed-in clients.
+  hwid?: {
     originalHWID: string
     currentHWID: string
     spoofed: boolean
   }
+  tls?: boolean
+}
+
+interface ScriptError {
+  kind: string
+  chunk?: string
+  line?: number
+  column?: number
+  message: string
+  traceback?: string
 }
 
 interface Feature {
@@ -110,6 +125,7 @@ interface Theme {
 interface UserType {
   username: string
   email: string
+  role?: "admin" | "operator" | "viewer"
   createdAt: string
   lastLogin: string
 }
@@ -307,6 +323,7 @@ export default function LuaExecutor() {
   const [connected, setConnected] = useState(false)
   const [connecting, setConnecting] = useState(false)
   const [serverStatus, setServerStatus] = useState<ServerStatus | null>(null)
+  const [apiScheme, setApiScheme] = useState<"http" | "https">("http")
   const [tcpDialogOpen, setTcpDialogOpen] = useState(false)
   const [currentTheme, setCurrentTheme] = useState<string>("emerald")
   const [renamingTab, setRenamingTab] = useState<string | null>(null)
@@ -329,17 +346,35 @@ export default function LuaExecutor() {
   const [password, setPassword] = useState("")
   const [confirmPassword, setConfirmPassword] = useState("")
   const [acceptTOS, setAcceptTOS] = useState(false)
+  const [inviteCode, setInviteCode] = useState("")
   const [formError, setFormError] = useState("")
 
   const wsRef = useRef<WebSocket | null>(null)
+  // Read when the WebSocket connects, which may be from a callback created
+  // before the token was loaded.
+  const authTokenRef = useRef<string | null>(null)
   const logEndRef = useRef<HTMLDivElement>(null)
   const retryTimeoutRef = useRef<NodeJS.Timeout | null>(null)
   const editorRef = useRef<any>(null)
+  const monacoRef = useRef<typeof monaco | null>(null)
   const renameInputRef = useRef<HTMLInputElement>(null)
   const titleRef = useRef<HTMLHeadingElement>(null)
 
   const theme = themes[currentTheme]
 
+  // An executor started with -bootstrap-port 8079 advertises its ports on a
+  // bootstrap endpoint, which saves scanning the candidate ports.
+  const discoverServer = async (): Promise<{ httpPort: number; tls: boolean } | null> => {
+    try {
+      const response = await fetch(`http://localhost:${BOOTSTRAP_PORT}/`, {
+        signal: AbortSignal.timeout(1000),
+      })
+      return response.ok ? await response.json() : null
+    } catch {
+      return null
+    }
+  }
+
   const fetchPortStatus = async (retryCount = 0, maxRetries = 3) => {
     if (retryCount > 0) {
       setLogs((prev) => [...prev, `[System] Retry attempt ${retryCount}/${maxRetries} to connect to server...`])
@@ -348,24 +383,54 @@ export default function LuaExecutor() {
     try {
       setConnecting(true)
 
+      const discovered = await discoverServer()
+
       const ports = [8080, 8081, 8082, 8083, 8084]
-      const port = ports[retryCount % ports.length]
+      const port = discovered ? discovered.httpPort : ports[retryCount % ports.length]
 
-      setLogs((prev) => [...prev, `[System] Trying to connect to port ${port}...`])
+      setLogs((prev) => [
+        ...prev,
+        discovered
+          ? `[System] Executor advertised on port ${port}, connecting...`
+          : `[System] Trying to connect to port ${port}...`,
+      ])
 
-      const response = await fetch(`http://localhost:${port}/port-status`, {
-        signal: AbortSignal.timeout(2000),
-      })
+      // The executor may be serving TLS, so try both schemes on each port.
+      const schemes: ("http" | "https")[] = discovered ? [discovered.tls ? "https" : "http"] : ["http", "https"]
+      let response: Response | null = null
+      let scheme: "http" | "https" = "http"
+      for (const candidate of schemes) {
+        try {
+          response = await fetch(`${candidate}://localhost:${port}/port-status`, {
+            headers: authToken ? { Authorization: `Bearer ${authToken}` } : undefined,
+            signal: AbortSignal.timeout(2000),
+          })
+          scheme = candidate
+          if (response.ok) break
+        } catch {
+          response = null
+        }
+      }
+
+      if (!response) {
+        throw new Error("Server is not reachable")
+      }
 
       if (response.ok) {
         const data = await response.json()
         setServerStatus(data)
+        setApiScheme(scheme)
         setLogs((prev) => [
           ...prev,
-          `[System] Found server on port ${data.port}`,
-          `[System] TCP server available on port ${data.tcpPort}`,
+          `[System] Found server on port ${data.port}${data.tls ? " (TLS)" : ""}`,
+          data.tcpPort
+            ? `[System] TCP server available on port ${data.tcpPort}`
+            : `[System] TCP server is not running`,
+          ...(data.status !== "listening"
+            ? [`[System] Server status: ${data.status}${data.lastError ? ` (${data.lastError})` : ""}`]
+            : []),
         ])
-        connectWebSocket(data.port)
+        connectWebSocket(data.port, scheme)
         return true
       }
       throw new Error(`Server responded with status: ${response.status}`)
@@ -392,14 +457,26 @@ export default function LuaExecutor() {
     }
   }
 
-  const connectWebSocket = (port: string) => {
-    if (wsRef.current && wsRef.current.readyState === WebSocket.OPEN) {
+  const connectWebSocket = (port: string, scheme: "http" | "https" = apiScheme) => {
+    const wsScheme = scheme === "https" ? "wss" : "ws"
+
+    if (wsRef.current && wsRef.current.readyState <= WebSocket.OPEN) {
       wsRef.current.close()
     }
 
+    // Browsers cannot set headers on a WebSocket, so the token goes in the URL.
+    const token = authTokenRef.current
+    if (!token) {
+      wsRef.current = null
+      setConnected(false)
+      setConnecting(false)
+      setLogs((prev) => [...prev, `[System] Sign in to follow the console output`])
+      return
+    }
+
     setLogs((prev) => [...prev, `[System] Connecting to WebSocket on port ${port}...`])
 
-    const ws = new WebSocket(`ws://localhost:${port}/ws`)
+    const ws = new WebSocket(`${wsScheme}://localhost:${port}/ws?token=${encodeURIComponent(token)}`)
 
     ws.onopen = () => {
       setConnected(true)
@@ -408,19 +485,44 @@ export default function LuaExecutor() {
         ...prev,
         `[System] Successfully connected to WebSocket on port ${port}`,
         `[System] Connection details:`,
-        `[System] - WebSocket URL: ws://localhost:${port}/ws`,
-        `[System] - HTTP API URL: http://localhost:${port}`,
+        `[System] - WebSocket URL: ${wsScheme}://localhost:${port}/ws`,
+        `[System] - HTTP API URL: ${scheme}://localhost:${port}`,
         `[System] - TCP Server: localhost:${serverStatus?.tcpPort || 9000}`,
       ])
     }
 
     ws.onmessage = (event) => {
       const message = event.data
+      if (typeof message === "string" && message.startsWith("{")) {
+        try {
+          const payload = JSON.parse(message)
+          if (payload.type === "port-status") {
+            setServerStatus((prev) =>
+              prev ? { ...prev, status: payload.status, lastError: payload.lastError, statusChangedAt: payload.changedAt } : prev,
+            )
+            setLogs((prev) => [
+              ...prev,
+              `[System] Server status: ${payload.status}${payload.lastError ? ` (${payload.lastError})` : ""}`,
+            ])
+            return
+          }
+          if (payload.type === "error" && payload.error) {
+            const prefix = payload.jobId ? `[Job ${payload.jobId}] ` : ""
+            setLogs((prev) => [...prev, `${prefix}[Error] ${formatScriptError(payload.error)}`])
+            markScriptError(payload.error)
+            return
+          }
+        } catch {
+          // not a structured event, fall through to plain log line
+        }
+      }
       setLogs((prev) => [...prev, message])
     }
 
     ws.onclose = () => {
-      setConnected(false)
+      if (wsRef.current === ws) {
+        setConnected(false)
+      }
       setLogs((prev) => [...prev, `[System] Disconnected from WebSocket`])
     }
 
@@ -458,6 +560,7 @@ export default function LuaExecutor() {
     }
 
     if (savedToken) {
+      authTokenRef.current = savedToken
       setAuthToken(savedToken)
     }
 
@@ -513,6 +616,18 @@ export default function LuaExecutor() {
     }
   }, [authToken])
 
+  // The console WebSocket is opened with the token, so reopen it when the
+  // user signs in or out.
+  useEffect(() => {
+    if (authTokenRef.current === authToken) {
+      return
+    }
+    authTokenRef.current = authToken
+    if (serverStatus) {
+      connectWebSocket(serverStatus.port, apiScheme)
+    }
+  }, [authToken])
+
   useEffect(() => {
     if (currentUser) {
       localStorage.setItem("canda-user", JSON.stringify(currentUser))
@@ -713,11 +828,11 @@ export default function LuaExecutor() {
     try {
       setLogs((prev) => [...prev, `[System] Executing script...`])
 
-      const response = await fetch(`http://localhost:${serverStatus.port}/execute`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus.port}/execute`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
-          Authorization: authToken,
+          Authorization: `Bearer ${authToken}`,
         },
         body: JSON.stringify({ script: currentScript }),
       })
@@ -735,16 +850,60 @@ export default function LuaExecutor() {
       }
 
       const result = await response.json()
-      if (result.error) {
+      const lines: string[] = (result.lines || []).map((line: { text: string }) => line.text)
+      if (lines.length > 0) {
+        setLogs((prev) => [...prev, ...lines])
+      }
+      if (result.truncated) {
+        setLogs((prev) => [...prev, `[System] Output truncated`])
+      }
+      markScriptError(result.errorDetails || null)
+      if (result.errorDetails) {
+        setLogs((prev) => [...prev, `[Error] ${formatScriptError(result.errorDetails)}`])
+      } else if (result.error) {
         setLogs((prev) => [...prev, `[Error] ${result.error}`])
+      } else if (result.results && result.results.length > 0) {
+        setLogs((prev) => [...prev, `[Result] ${JSON.stringify(result.results)}`])
       } else {
-        setLogs((prev) => [...prev, `[Execution] ${result.output || "Script executed successfully"}`])
+        setLogs((prev) => [...prev, `[Execution] Script executed successfully`])
       }
     } catch (error) {
       setLogs((prev) => [...prev, `[Error] ${error instanceof Error ? error.message : "Unknown error"}`])
     }
   }
 
+  const formatScriptError = (error: ScriptError) => {
+    const position = error.line ? `${error.chunk}:${error.line}: ` : ""
+    return `${error.kind}: ${position}${error.message}`
+  }
+
+  const markScriptError = (error: ScriptError | null) => {
+    const editor = editorRef.current
+    const monacoInstance = monacoRef.current
+    if (!editor || !monacoInstance) return
+
+    const model = editor.getModel()
+    if (!model) return
+
+    if (!error || !error.line) {
+      monacoInstance.editor.setModelMarkers(model, "canda", [])
+      return
+    }
+
+    const line = Math.min(error.line, model.getLineCount())
+    monacoInstance.editor.setModelMarkers(model, "canda", [
+      {
+        startLineNumber: line,
+        startColumn: error.column || 1,
+        endLineNumber: line,
+        endColumn: model.getLineMaxColumn(line),
+        message: `${error.kind}: ${error.message}`,
+        severity: monacoInstance.MarkerSeverity.Error,
+      },
+    ])
+    editor.revealLineInCenter(line)
+  }
+
   const reconnectWebSocket = async () => {
     setLogs((prev) => [
       ...prev,
@@ -768,7 +927,7 @@ export default function LuaExecutor() {
     }
 
     try {
-      const response = await fetch(`http://localhost:${serverStatus?.port}/login`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus?.port}/login`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -814,12 +973,12 @@ export default function LuaExecutor() {
     }
 
     try {
-      const response = await fetch(`http://localhost:${serverStatus?.port}/register`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus?.port}/register`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
         },
-        body: JSON.stringify({ username, email, password, confirmPassword, acceptTOS }),
+        body: JSON.stringify({ username, email, password, confirmPassword, acceptTOS, inviteCode }),
       })
 
       const data = await response.json()
@@ -839,6 +998,7 @@ export default function LuaExecutor() {
       setPassword("")
       setConfirmPassword("")
       setAcceptTOS(false)
+      setInviteCode("")
     } catch (error) {
       setFormError("Failed to connect to authentication server")
     }
@@ -864,11 +1024,11 @@ export default function LuaExecutor() {
     }
 
     try {
-      const response = await fetch(`http://localhost:${serverStatus?.port}/inject`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus?.port}/inject`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
-          Authorization: authToken,
+          Authorization: `Bearer ${authToken}`,
         },
         body: JSON.stringify({ processName }),
       })
@@ -908,11 +1068,11 @@ export default function LuaExecutor() {
     }
 
     try {
-      const response = await fetch(`http://localhost:${serverStatus?.port}/spoof-hwid`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus?.port}/spoof-hwid`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
-          Authorization: authToken,
+          Authorization: `Bearer ${authToken}`,
         },
         body: JSON.stringify({ customHWID }),
       })
@@ -957,11 +1117,11 @@ export default function LuaExecutor() {
     }
 
     try {
-      const response = await fetch(`http://localhost:${serverStatus?.port}/features`, {
+      const response = await fetch(`${apiScheme}://localhost:${serverStatus?.port}/features`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
-          Authorization: authToken,
+          Authorization: `Bearer ${authToken}`,
         },
         body: JSON.stringify({ name: featureName, enabled }),
       })
@@ -1544,6 +1704,7 @@ export default function LuaExecutor() {
                 onChange={handleEditorChange}
                 onMount={(editor, monacoInstance) => {
                   editorRef.current = editor
+                  monacoRef.current = monacoInstance
                   defineTheme(monacoInstance, currentTheme)
                 }}
                 options={{
@@ -1929,6 +2090,16 @@ export default function LuaExecutor() {
                   </div>
                 </div>
 
+                <div className="space-y-2">
+                  <Label htmlFor="inviteCode">Invite Code (if required)</Label>
+                  <Input
+                    id="inviteCode"
+                    placeholder="Enter your invite code"
+                    value={inviteCode}
+                    onChange={(e) => setInviteCode(e.target.value)}
+                  />
+                </div>
+
                 <div className="flex items-center space-x-2">
                   <Checkbox
                     id="terms"
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a Go duration string ("30s", "24h")
+// in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// HTTPConfig lists the ports tried in order; 0 lets the OS choose.
+type HTTPConfig struct {
+	Ports []int `json:"ports"`
+}
+
+// TCPConfig.APIKeys maps a name to the key that signs in as it, and
+// APIKeyRoles gives a name the role it signs in with; a key whose name has
+// no account and no role there is a viewer.
+type TCPConfig struct {
+	Port            int               `json:"port"`
+	APIKeys         map[string]string `json:"apiKeys,omitempty"`
+	APIKeyRoles     map[string]string `json:"apiKeyRoles,omitempty"`
+	MaxAuthFailures int               `json:"maxAuthFailures"`
+	AuthLockout     Duration          `json:"authLockout"`
+}
+
+// AuthConfig.StoreFile is where accounts and sessions are kept; empty keeps
+// them in memory only. PasswordMemoryKiB and PasswordPasses are the argon2id
+// cost for new password hashes; raising them upgrades existing ones as users
+// log in. Registration is "open", "invite" (InviteCode required) or
+// "closed", and DefaultRole is what every new account gets. AdminUser is
+// made an admin at startup, and created with AdminPassword if it does not
+// exist; it is how a server gets its first admin.
+type AuthConfig struct {
+	SessionLifetime   Duration `json:"sessionLifetime"`
+	StoreFile         string   `json:"storeFile"`
+	PasswordMemoryKiB int      `json:"passwordMemoryKiB"`
+	PasswordPasses    int      `json:"passwordPasses"`
+	Registration      string   `json:"registration"`
+	InviteCode        string   `json:"inviteCode,omitempty"`
+	DefaultRole       string   `json:"defaultRole"`
+	AdminUser         string   `json:"adminUser,omitempty"`
+	AdminPassword     string   `json:"adminPassword,omitempty"`
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize  int      `json:"readBufferSize"`
+	WriteBufferSize int      `json:"writeBufferSize"`
+	SendQueueSize   int      `json:"sendQueueSize"`
+	MaxMessageSize  int64    `json:"maxMessageSize"`
+	WriteTimeout    Duration `json:"writeTimeout"`
+	PongTimeout     Duration `json:"pongTimeout"`
+	PingInterval    Duration `json:"pingInterval"`
+}
+
+type SchedulerConfig struct {
+	Workers      int `json:"workers"`
+	QueueSize    int `json:"queueSize"`
+	QueuePerUser int `json:"queuePerUser"`
+	PerUser      int `json:"perUser"`
+}
+
+type LuaSessionConfig struct {
+	MaxPerUser  int      `json:"maxPerUser"`
+	IdleTimeout Duration `json:"idleTimeout"`
+}
+
+type SandboxConfig struct {
+	DefaultProfile string            `json:"defaultProfile,omitempty"`
+	Users          map[string]string `json:"users,omitempty"`
+}
+
+// Config is everything that can differ between deployments. Values are
+// layered: built-in defaults, then the JSON file, then CANDA_* environment
+// variables, then command-line flags.
+type Config struct {
+	Listen      ListenSettings   `json:"listen"`
+	HTTP        HTTPConfig       `json:"http"`
+	TCP         TCPConfig        `json:"tcp"`
+	TLS         TLSSettings      `json:"tls"`
+	Auth        AuthConfig       `json:"auth"`
+	WebSocket   WebSocketConfig  `json:"websocket"`
+	Scheduler   SchedulerConfig  `json:"scheduler"`
+	LuaSessions LuaSessionConfig `json:"luaSessions"`
+	Sandbox     SandboxConfig    `json:"sandbox"`
+	Discovery   DiscoveryConfig  `json:"discovery"`
+	// ShutdownTimeout bounds how long running executions may take to finish
+	// after SIGINT or SIGTERM before they are cancelled.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// Limits maps a role to "timeout/steps[/memory]", as in CANDA_EXEC_LIMITS.
+	Limits map[string]string `json:"limits,omitempty"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ListenSettings{
+			BindAddr: defaultBindAddr,
+		},
+		HTTP: HTTPConfig{
+			Ports: []int{8080, 8081, 8082, 8083, 8084},
+		},
+		TCP: TCPConfig{
+			Port:            9000,
+			MaxAuthFailures: 5,
+			AuthLockout:     Duration(5 * time.Minute),
+		},
+		Auth: AuthConfig{
+			SessionLifetime:   Duration(24 * time.Hour),
+			StoreFile:         userConfigPath("auth.json"),
+			PasswordMemoryKiB: defaultPasswordMemory,
+			PasswordPasses:    defaultPasswordPasses,
+			Registration:      RegistrationOpen,
+			DefaultRole:       RoleViewer,
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			SendQueueSize:   256,
+			MaxMessageSize:  512 * 1024,
+			WriteTimeout:    Duration(10 * time.Second),
+			PongTimeout:     Duration(60 * time.Second),
+			PingInterval:    Duration(30 * time.Second),
+		},
+		Scheduler: SchedulerConfig{
+			Workers:      runtime.NumCPU(),
+			QueueSize:    64,
+			QueuePerUser: 16,
+			PerUser:      2,
+		},
+		LuaSessions: LuaSessionConfig{
+			MaxPerUser:  4,
+			IdleTimeout: Duration(30 * time.Minute),
+		},
+		Discovery: DiscoveryConfig{
+			File: userConfigPath("executor.json"),
+		},
+		ShutdownTimeout: Duration(30 * time.Second),
+	}
+}
+
+// userConfigPath places name in canda/ under the user's config directory,
+// e.g. ~/.config/canda on Linux. It is empty if there is no such directory.
+func userConfigPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "canda", name)
+}
+
+// LoadConfig builds the configuration from args (without the program name).
+// The file is named by -config or CANDA_CONFIG.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("canda-executor", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CANDA_CONFIG"), "path to a JSON config file")
+	bind := fs.String("bind", "", "address to bind listeners to")
+	httpPorts := fs.String("http-ports", "", "comma-separated HTTP port candidates")
+	tcpPort := fs.Int("tcp-port", 0, "TCP console port")
+	httpSocket := fs.String("http-socket", "", "Unix socket for the HTTP API")
+	tcpSocket := fs.String("tcp-socket", "", "Unix socket for the TCP console")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file")
+	tlsKey := fs.String("tls-key", "", "TLS key file")
+	selfSigned := fs.Bool("tls-self-signed", false, "serve TLS with a generated development certificate")
+	clientCA := fs.String("tls-client-ca", "", "CA file for TCP client certificates")
+	workers := fs.Int("workers", 0, "number of execution workers")
+	discoveryFile := fs.String("discovery-file", "", "where to publish the discovery file (empty disables it)")
+	bootstrapPort := fs.Int("bootstrap-port", 0, "port of the discovery bootstrap endpoint (0 disables it)")
+	authStore := fs.String("auth-store", "", "file that keeps accounts and sessions (empty keeps them in memory)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			cfg.Listen.BindAddr = *bind
+		case "http-ports":
+			ports, err := parsePortList(*httpPorts)
+			if err != nil {
+				flagErr = fmt.Errorf("-http-ports: %w", err)
+			}
+			cfg.HTTP.Ports = ports
+		case "tcp-port":
+			cfg.TCP.Port = *tcpPort
+		case "http-socket":
+			cfg.Listen.HTTPSocket = *httpSocket
+		case "tcp-socket":
+			cfg.Listen.TCPSocket = *tcpSocket
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = *selfSigned
+		case "tls-client-ca":
+			cfg.TLS.ClientCAFile = *clientCA
+		case "workers":
+			cfg.Scheduler.Workers = *workers
+		case "discovery-file":
+			cfg.Discovery.File = *discoveryFile
+		case "bootstrap-port":
+			cfg.Discovery.BootstrapPort = *bootstrapPort
+		case "auth-store":
+			cfg.Auth.StoreFile = *authStore
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (cfg *Config) applyEnv() error {
+	env := &envReader{}
+
+	env.str("CANDA_BIND_ADDR", &cfg.Listen.BindAddr)
+	env.str("CANDA_HTTP_SOCKET", &cfg.Listen.HTTPSocket)
+	env.str("CANDA_TCP_SOCKET", &cfg.Listen.TCPSocket)
+	env.ports("CANDA_HTTP_PORTS", &cfg.HTTP.Ports)
+	env.int("CANDA_TCP_PORT", &cfg.TCP.Port)
+	env.pairs("CANDA_TCP_API_KEYS", &cfg.TCP.APIKeys)
+	env.pairs("CANDA_TCP_API_KEY_ROLES", &cfg.TCP.APIKeyRoles)
+	env.int("CANDA_TCP_AUTH_MAX_FAILURES", &cfg.TCP.MaxAuthFailures)
+	env.duration("CANDA_TCP_AUTH_LOCKOUT_SECONDS", time.Second, &cfg.TCP.AuthLockout)
+	env.str("CANDA_TLS_CERT", &cfg.TLS.CertFile)
+	env.str("CANDA_TLS_KEY", &cfg.TLS.KeyFile)
+	env.bool("CANDA_TLS_SELF_SIGNED", &cfg.TLS.SelfSigned)
+	env.str("CANDA_TLS_CLIENT_CA", &cfg.TLS.ClientCAFile)
+	env.pairs("CANDA_TLS_CLIENT_ROLES", &cfg.TLS.ClientRoles)
+	env.duration("CANDA_SESSION_LIFETIME_HOURS", time.Hour, &cfg.Auth.SessionLifetime)
+	env.str("CANDA_AUTH_STORE", &cfg.Auth.StoreFile)
+	env.int("CANDA_PASSWORD_MEMORY_KIB", &cfg.Auth.PasswordMemoryKiB)
+	env.int("CANDA_PASSWORD_PASSES", &cfg.Auth.PasswordPasses)
+	env.str("CANDA_REGISTRATION", &cfg.Auth.Registration)
+	env.str("CANDA_INVITE_CODE", &cfg.Auth.InviteCode)
+	env.str("CANDA_DEFAULT_ROLE", &cfg.Auth.DefaultRole)
+	env.str("CANDA_ADMIN_USER", &cfg.Auth.AdminUser)
+	env.str("CANDA_ADMIN_PASSWORD", &cfg.Auth.AdminPassword)
+	env.int("CANDA_EXEC_WORKERS", &cfg.Scheduler.Workers)
+	env.int("CANDA_EXEC_QUEUE", &cfg.Scheduler.QueueSize)
+	env.int("CANDA_EXEC_QUEUE_PER_USER", &cfg.Scheduler.QueuePerUser)
+	env.int("CANDA_EXEC_PER_USER", &cfg.Scheduler.PerUser)
+	env.int("CANDA_LUA_SESSIONS_PER_USER", &cfg.LuaSessions.MaxPerUser)
+	env.duration("CANDA_LUA_SESSION_IDLE_MINUTES", time.Minute, &cfg.LuaSessions.IdleTimeout)
+	env.str("CANDA_SANDBOX_PROFILE", &cfg.Sandbox.DefaultProfile)
+	env.pairs("CANDA_SANDBOX_USERS", &cfg.Sandbox.Users)
+	env.pairs("CANDA_EXEC_LIMITS", &cfg.Limits)
+	env.str("CANDA_DISCOVERY_FILE", &cfg.Discovery.File)
+	env.int("CANDA_BOOTSTRAP_PORT", &cfg.Discovery.BootstrapPort)
+	env.duration("CANDA_SHUTDOWN_TIMEOUT_SECONDS", time.Second, &cfg.ShutdownTimeout)
+
+	return errors.Join(env.errs...)
+}
+
+// Validate rejects settings the server cannot start with. Sandbox profile
+// names are checked when the sandbox registry is configured.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.Listen.BindAddr != "", "listen.bindAddr must not be empty")
+
+	check(len(cfg.HTTP.Ports) > 0, "http.ports must list at least one port")
+	for _, port := range cfg.HTTP.Ports {
+		check(port >= 0 && port < 65536, "http.ports: %d is not a valid port", port)
+		check(port == 0 || port != cfg.TCP.Port, "http.ports: %d is also the TCP port", port)
+	}
+	check(cfg.TCP.Port >= 0 && cfg.TCP.Port < 65536, "tcp.port: %d is not a valid port", cfg.TCP.Port)
+	check(cfg.TCP.MaxAuthFailures > 0, "tcp.maxAuthFailures must be positive")
+	check(cfg.TCP.AuthLockout > 0, "tcp.authLockout must be positive")
+	for name, key := range cfg.TCP.APIKeys {
+		check(name != "" && key != "", "tcp.apiKeys entries need a name and a key")
+	}
+	for name, role := range cfg.TCP.APIKeyRoles {
+		_, exists := cfg.TCP.APIKeys[name]
+		check(exists, "tcp.apiKeyRoles: %q has no API key", name)
+		check(validRole(role), "tcp.apiKeyRoles: %q is not a role", role)
+	}
+
+	check(cfg.TLS.CertFile == "" || cfg.TLS.KeyFile != "", "tls.keyFile is required with tls.certFile")
+	check(cfg.TLS.KeyFile == "" || cfg.TLS.CertFile != "", "tls.certFile is required with tls.keyFile")
+	check(cfg.TLS.CertFile == "" || !cfg.TLS.SelfSigned, "tls.certFile and tls.selfSigned are mutually exclusive")
+	check(cfg.TLS.ClientCAFile == "" || cfg.TLS.Enabled(), "tls.clientCAFile requires a certificate or tls.selfSigned")
+	check(len(cfg.TLS.ClientRoles) == 0 || cfg.TLS.ClientCAFile != "", "tls.clientRoles requires tls.clientCAFile")
+	for _, role := range cfg.TLS.ClientRoles {
+		check(validRole(role), "tls.clientRoles: %q is not a role", role)
+	}
+
+	check(cfg.Auth.SessionLifetime > 0, "auth.sessionLifetime must be positive")
+	check(cfg.Auth.PasswordMemoryKiB >= minPasswordMemory && cfg.Auth.PasswordMemoryKiB <= maxPasswordMemory,
+		"auth.passwordMemoryKiB must be between %d and %d", minPasswordMemory, maxPasswordMemory)
+	check(cfg.Auth.PasswordPasses >= 1 && cfg.Auth.PasswordPasses <= maxPasswordPasses,
+		"auth.passwordPasses must be between 1 and %d", maxPasswordPasses)
+	switch cfg.Auth.Registration {
+	case RegistrationOpen, RegistrationClosed:
+	case RegistrationInvite:
+		check(cfg.Auth.InviteCode != "", "auth.inviteCode is required when auth.registration is invite")
+	default:
+		check(false, "auth.registration: %q is not open, invite or closed", cfg.Auth.Registration)
+	}
+	check(cfg.Auth.DefaultRole == RoleOperator || cfg.Auth.DefaultRole == RoleViewer, "auth.defaultRole: %q is not operator or viewer", cfg.Auth.DefaultRole)
+	if cfg.Auth.AdminUser != "" {
+		check(len(cfg.Auth.AdminUser) >= 3 && len(cfg.Auth.AdminUser) <= 20, "auth.adminUser must be between 3 and 20 characters")
+		check(len(cfg.Auth.AdminPassword) >= 8, "auth.adminPassword of at least 8 characters is required with auth.adminUser")
+	}
+	check(cfg.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+
+	ws := cfg.WebSocket
+	check(ws.ReadBufferSize > 0 && ws.WriteBufferSize > 0, "websocket buffer sizes must be positive")
+	check(ws.SendQueueSize > 0, "websocket.sendQueueSize must be positive")
+	check(ws.MaxMessageSize > 0, "websocket.maxMessageSize must be positive")
+	check(ws.WriteTimeout > 0, "websocket.writeTimeout must be positive")
+	check(ws.PingInterval > 0 && ws.PingInterval < ws.PongTimeout, "websocket.pingInterval must be positive and shorter than pongTimeout")
+
+	check(cfg.Scheduler.Workers > 0, "scheduler.workers must be positive")
+	check(cfg.Scheduler.QueueSize > 0, "scheduler.queueSize must be positive")
+	check(cfg.Scheduler.QueuePerUser > 0 && cfg.Scheduler.QueuePerUser <= cfg.Scheduler.QueueSize, "scheduler.queuePerUser must be positive and at most queueSize")
+	check(cfg.Scheduler.PerUser > 0, "scheduler.perUser must be positive")
+
+	check(cfg.LuaSessions.MaxPerUser > 0, "luaSessions.maxPerUser must be positive")
+	check(cfg.LuaSessions.IdleTimeout > 0, "luaSessions.idleTimeout must be positive")
+
+	if port := cfg.Discovery.BootstrapPort; port != 0 {
+		check(port > 0 && port <= 65535, "discovery.bootstrapPort %d is out of range", port)
+		for _, candidate := range cfg.HTTP.Ports {
+			check(port != candidate, "discovery.bootstrapPort %d is also an HTTP port", port)
+		}
+		check(port != cfg.TCP.Port, "discovery.bootstrapPort %d is also the TCP port", port)
+	}
+
+	for role, spec := range cfg.Limits {
+		if _, err := parseLimitsSpec(ExecutionLimits{}, spec); err != nil {
+			errs = append(errs, fmt.Errorf("limits.%s: %w", role, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// envReader applies CANDA_* variables that are set, collecting every parse
+// error instead of stopping at the first.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) lookup(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	return strings.TrimSpace(value), ok && strings.TrimSpace(value) != ""
+}
+
+func (e *envReader) fail(name string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+}
+
+func (e *envReader) str(name string, dst *string) {
+	if value, ok := e.lookup(name); ok {
+		*dst = value
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*dst = b
+}
+
+// duration reads a whole number of units, matching the variable's name.
+func (e *envReader) duration(name string, unit time.Duration, dst *Duration) {
+	n := 0
+	if _, ok := e.lookup(name); !ok {
+		return
+	}
+
+	before := len(e.errs)
+	e.int(name, &n)
+	if len(e.errs) == before {
+		*dst = Duration(time.Duration(n) * unit)
+	}
+}
+
+func (e *envReader) ports(name string, dst *[]int) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+
+	ports, err := parsePortList(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*dst = ports
+}
+
+// pairs reads "name=value,name=value" and merges it into dst.
+func (e *envReader) pairs(name string, dst *map[string]string) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+
+	if *dst == nil {
+		*dst = make(map[string]string)
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, val, found := strings.Cut(entry, "=")
+		if !found {
+			e.fail(name, fmt.Errorf("malformed entry %q, expected name=value", entry))
+			continue
+		}
+		(*dst)[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+}
+
+func parsePortList(value string) ([]int, error) {
+	ports := make([]int, 0)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const maxResultDepth = 64
+
+// luaToJSON converts a Lua value into something encoding/json can marshal.
+// Tables whose keys are exactly 1..n become arrays (an empty table becomes an
+// empty array); any other table becomes an object with stringified keys.
+// Shared sub-tables are fine, but a table that contains itself is rejected.
+func luaToJSON(value lua.LValue) (interface{}, error) {
+	return convertLuaValue(value, make(map[*lua.LTable]bool), 0)
+}
+
+func convertLuaValue(value lua.LValue, path map[*lua.LTable]bool, depth int) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, nil
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		return convertLuaTable(v, path, depth)
+	}
+	return nil, fmt.Errorf("cannot convert %s to JSON", value.Type().String())
+}
+
+func convertLuaTable(tb *lua.LTable, path map[*lua.LTable]bool, depth int) (interface{}, error) {
+	if path[tb] {
+		return nil, fmt.Errorf("cannot convert table with a cycle to JSON")
+	}
+	if depth >= maxResultDepth {
+		return nil, fmt.Errorf("table nesting exceeds %d levels", maxResultDepth)
+	}
+
+	path[tb] = true
+	defer delete(path, tb)
+
+	keys := 0
+	maxKey := 0
+	isArray := true
+	tb.ForEach(func(key, _ lua.LValue) {
+		keys++
+		n, ok := key.(lua.LNumber)
+		if !ok || float64(n) != math.Trunc(float64(n)) || n < 1 {
+			isArray = false
+			return
+		}
+		if int(n) > maxKey {
+			maxKey = int(n)
+		}
+	})
+	if maxKey != keys {
+		isArray = false
+	}
+
+	var err error
+
+	if isArray {
+		arr := make([]interface{}, keys)
+		for i := 1; i <= keys && err == nil; i++ {
+			arr[i-1], err = convertLuaValue(tb.RawGet(lua.LNumber(i)), path, depth+1)
+		}
+		return arr, err
+	}
+
+	obj := make(map[string]interface{}, keys)
+	tb.ForEach(func(key, val lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		var name string
+		switch k := key.(type) {
+		case lua.LString:
+			name = string(k)
+		case lua.LNumber, lua.LBool:
+			name = k.String()
+		default:
+			err = fmt.Errorf("cannot use %s as a JSON object key", key.Type().String())
+			return
+		}
+
+		obj[name], err = convertLuaValue(val, path, depth+1)
+	})
+
+	return obj, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// version is overridden at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// DiscoveryInfo tells clients where this executor is listening, so they do
+// not have to scan the candidate ports.
+type DiscoveryInfo struct {
+	PID            int       `json:"pid"`
+	Version        string    `json:"version"`
+	BindAddr       string    `json:"bindAddr"`
+	HTTPPort       int       `json:"httpPort"`
+	TCPPort        int       `json:"tcpPort"`
+	HTTPSocket     string    `json:"httpSocket,omitempty"`
+	TCPSocket      string    `json:"tcpSocket,omitempty"`
+	TLS            bool      `json:"tls"`
+	TLSFingerprint string    `json:"tlsFingerprint,omitempty"`
+	StartedAt      time.Time `json:"startedAt"`
+	WireProtocol   int       `json:"wireProtocol"`
+}
+
+// DiscoveryConfig controls how the executor advertises itself. An empty File
+// or a zero BootstrapPort disables that mode. The bootstrap endpoint listens
+// on the same address as the other servers.
+type DiscoveryConfig struct {
+	File          string `json:"file"`
+	BootstrapPort int    `json:"bootstrapPort"`
+}
+
+func newDiscoveryInfo(cfg *Config, httpPort int, startedAt time.Time) DiscoveryInfo {
+	info := DiscoveryInfo{
+		PID:          os.Getpid(),
+		Version:      version,
+		BindAddr:     cfg.Listen.BindAddr,
+		HTTPPort:     httpPort,
+		TCPPort:      tcpPort,
+		HTTPSocket:   cfg.Listen.HTTPSocket,
+		TCPSocket:    cfg.Listen.TCPSocket,
+		TLS:          tlsConfig != nil,
+		StartedAt:    startedAt,
+		WireProtocol: wireProtocolVersion,
+	}
+
+	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
+		info.TLSFingerprint = certFingerprint(tlsConfig.Certificates[0])
+	}
+
+	return info
+}
+
+// writeDiscoveryFile replaces the file atomically so readers never see a
+// partial document. It is readable by the current user only.
+func writeDiscoveryFile(path string, info DiscoveryInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// removeDiscoveryFile deletes the file unless another executor has since
+// replaced it with its own.
+func removeDiscoveryFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var info DiscoveryInfo
+	if json.Unmarshal(data, &info) == nil && info.PID != os.Getpid() {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove discovery file: %v", err)
+	}
+}
+
+// startBootstrapServer serves the discovery document over plain HTTP on a
+// fixed port, for clients that cannot read the file.
+func startBootstrapServer(addr string, info DiscoveryInfo) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+
+	server := &http.Server{Handler: enableCORS(mux)}
+	go server.Serve(listener)
+
+	log.Printf("Bootstrap endpoint listening on %s", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	ErrCodeSyntax           = "syntax"
+	ErrCodeRuntime          = "runtime"
+	ErrCodeSandboxViolation = "sandbox_violation"
+)
+
+var luaErrorPosition = regexp.MustCompile(`^(.+?):(\d+): (?s)(.*)$`)
+
+// ExecutionError is the structured form of every way a script can fail. Kind
+// is one of the ErrCode constants; position fields are zero when unknown.
+type ExecutionError struct {
+	Kind      string `json:"kind"`
+	Chunk     string `json:"chunk,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	Message   string `json:"message"`
+	Traceback string `json:"traceback,omitempty"`
+}
+
+func (e *ExecutionError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s: %s:%d: %s", e.Kind, e.Chunk, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// validateLuaScript parses and compiles script without running it. The
+// gopher-lua parser stops at the first error, so at most one diagnostic is
+// returned.
+func validateLuaScript(script string, chunk string) []*ExecutionError {
+	diagnostics := make([]*ExecutionError, 0)
+
+	stmts, err := parse.Parse(strings.NewReader(script), chunk)
+	if err == nil {
+		_, err = lua.Compile(stmts, chunk)
+	}
+
+	if err != nil {
+		diagnostics = append(diagnostics, classifyError(&lua.ApiError{
+			Type:   lua.ApiErrorSyntax,
+			Object: lua.LString(err.Error()),
+			Cause:  err,
+		}, chunk, script))
+	}
+
+	return diagnostics
+}
+
+// classifyError turns an error from loading or running chunk, whose source
+// is script, into an ExecutionError, pulling positions out of the parser
+// error or the "chunk:line:" prefix gopher-lua puts on runtime messages.
+func classifyError(err error, chunk string, script string) *ExecutionError {
+	var execErr *ExecutionError
+	if errors.As(err, &execErr) {
+		return execErr
+	}
+
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return &ExecutionError{Kind: ErrCodeRuntime, Chunk: chunk, Message: err.Error()}
+	}
+
+	if apiErr.Type == lua.ApiErrorSyntax {
+		execErr = &ExecutionError{Kind: ErrCodeSyntax, Chunk: chunk}
+
+		var parseErr *parse.Error
+		var compileErr *lua.CompileError
+		switch {
+		case errors.As(apiErr.Cause, &parseErr):
+			execErr.Line = parseErr.Pos.Line
+			execErr.Column = parseErr.Pos.Column
+			execErr.Message = parseErr.Message
+			if parseErr.Token != "" {
+				execErr.Message = fmt.Sprintf("%s near '%s'", parseErr.Message, parseErr.Token)
+			}
+		case errors.As(apiErr.Cause, &compileErr):
+			execErr.Line = compileErr.Line
+			execErr.Message = compileErr.Message
+		default:
+			execErr.Message = apiErr.Object.String()
+		}
+
+		// The parser has no position for an unexpected end of input, such
+		// as a missing "end"; point at the last line with code on it.
+		if execErr.Line < 0 {
+			execErr.Line = strings.Count(strings.TrimRight(script, " \t\r\n"), "\n") + 1
+			execErr.Column = 0
+		}
+		return execErr
+	}
+
+	execErr = &ExecutionError{
+		Kind:      ErrCodeRuntime,
+		Chunk:     chunk,
+		Message:   apiErr.Object.String(),
+		Traceback: apiErr.StackTrace,
+	}
+
+	if match := luaErrorPosition.FindStringSubmatch(execErr.Message); match != nil {
+		execErr.Chunk = match[1]
+		execErr.Line, _ = strconv.Atoi(match[2])
+		execErr.Message = match[3]
+	}
+
+	return execErr
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// authStoreVersion is the schema version written to the store file. Files
+// with any other version are refused rather than guessed at.
+const authStoreVersion = 1
+
+type authFile struct {
+	Version  int             `json:"version"`
+	Users    []userRecord    `json:"users"`
+	Sessions []sessionRecord `json:"sessions"`
+}
+
+// userRecord is a User as stored, including the password hash that the API
+// never serialises.
+type userRecord struct {
+	User
+	PasswordHash string `json:"passwordHash"`
+}
+
+type sessionRecord struct {
+	Session
+	TokenHash string `json:"tokenHash"`
+}
+
+// FileStore is an AuthStore backed by one JSON file. Reads are served from
+// memory; every change rewrites the file atomically before it takes effect,
+// so a failed write leaves both the file and the store as they were.
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// OpenFileStore loads the store at path, or starts empty if the file does
+// not exist yet. Sessions that have already expired are dropped.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file authFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Version != authStoreVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d, want %d", path, file.Version, authStoreVersion)
+	}
+
+	for _, record := range file.Users {
+		user := record.User
+		user.PasswordHash = record.PasswordHash
+		s.users[userKey(user.Username)] = &user
+	}
+
+	now := time.Now()
+	for _, record := range file.Sessions {
+		if now.Before(record.ExpiresAt) {
+			session := record.Session
+			session.TokenHash = record.TokenHash
+			s.sessions[session.TokenHash] = &session
+		}
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) PutUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := userKey(user.Username)
+	previous, existed := s.users[key]
+
+	copied := *user
+	s.users[key] = &copied
+
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.users[key] = previous
+		} else {
+			delete(s.users, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) UpdateUser(username string, update func(*User)) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := userKey(username)
+	previous, exists := s.users[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	updated := *previous
+	update(&updated)
+	s.users[key] = &updated
+
+	if err := s.saveLocked(); err != nil {
+		s.users[key] = previous
+		return nil, err
+	}
+
+	copied := updated
+	return &copied, nil
+}
+
+func (s *FileStore) PutSession(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.sessions[session.TokenHash]
+
+	copied := *session
+	s.sessions[session.TokenHash] = &copied
+
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.sessions[session.TokenHash] = previous
+		} else {
+			delete(s.sessions, session.TokenHash)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) ExtendSession(tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.sessions[tokenHash]
+	if !exists {
+		return ErrNotFound
+	}
+
+	extended := *previous
+	extended.ExpiresAt = expiresAt
+	s.sessions[tokenHash] = &extended
+
+	if err := s.saveLocked(); err != nil {
+		s.sessions[tokenHash] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) DeleteSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.sessions[tokenHash]
+	if !existed {
+		return nil
+	}
+	delete(s.sessions, tokenHash)
+
+	if err := s.saveLocked(); err != nil {
+		s.sessions[tokenHash] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) DeleteExpiredSessions(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := s.expireLocked(now)
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if err := s.saveLocked(); err != nil {
+		for tokenHash, session := range expired {
+			s.sessions[tokenHash] = session
+		}
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (s *FileStore) saveLocked() error {
+	file := authFile{
+		Version:  authStoreVersion,
+		Users:    make([]userRecord, 0, len(s.users)),
+		Sessions: make([]sessionRecord, 0, len(s.sessions)),
+	}
+
+	for _, user := range s.users {
+		file.Users = append(file.Users, userRecord{User: *user, PasswordHash: user.PasswordHash})
+	}
+	for _, session := range s.sessions {
+		file.Sessions = append(file.Sessions, sessionRecord{Session: *session, TokenHash: session.TokenHash})
+	}
+
+	// Sorted so the file only changes where the data does.
+	sort.Slice(file.Users, func(i, j int) bool {
+		return userKey(file.Users[i].Username) < userKey(file.Users[j].Username)
+	})
+	sort.Slice(file.Sessions, func(i, j int) bool {
+		return file.Sessions[i].TokenHash < file.Sessions[j].TokenHash
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, append(data, '\n'), 0600)
+}
+
+// writeFileAtomic replaces path with data so readers, and the file after a
+// crash, hold either the old contents or the new ones, never a mix. Missing
+// parent directories are created private to the current user.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
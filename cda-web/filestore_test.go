@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreRejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	data := []byte(`{"version": 2, "users": [], "sessions": []}`)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileStore(path); err == nil {
+		t.Fatal("OpenFileStore accepted a file with an unknown schema version")
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, data) {
+		t.Errorf("refused file was rewritten:\n%s", after)
+	}
+}
+
+func TestFileStoreFailedWriteChangesNothing(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "canda")
+	path := filepath.Join(dir, "auth.json")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.PutUser(&User{Username: "alice", Email: "alice@example.com", Role: RoleOperator}); err != nil {
+		t.Fatalf("PutUser: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Put a plain file where the store's directory was, so every write
+	// fails, and keep the real directory aside to check the file in it.
+	moved := filepath.Join(root, "moved")
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutUser(&User{Username: "alice", Email: "changed@example.com", Role: RoleAdmin}); err == nil {
+		t.Fatal("PutUser succeeded without a directory to write to")
+	}
+	if err := store.PutUser(&User{Username: "bob", Role: RoleViewer}); err == nil {
+		t.Fatal("PutUser of a new user succeeded without a directory to write to")
+	}
+	session := &Session{ID: "s1", UserID: "alice", ExpiresAt: time.Now().Add(time.Hour), TokenHash: hashToken("token")}
+	if err := store.PutSession(session); err == nil {
+		t.Fatal("PutSession succeeded without a directory to write to")
+	}
+
+	alice, err := store.GetUser("alice")
+	if err != nil {
+		t.Fatalf("GetUser(alice): %v", err)
+	}
+	if alice.Email != "alice@example.com" || alice.Role != RoleOperator {
+		t.Errorf("alice changed in memory after a failed write: %+v", alice)
+	}
+	if _, err := store.GetUser("bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("bob added in memory after a failed write: %v", err)
+	}
+	if _, err := store.GetSession(session.TokenHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("session added in memory after a failed write: %v", err)
+	}
+
+	after, err := os.ReadFile(filepath.Join(moved, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("file changed after a failed write:\n%s\nwant:\n%s", after, before)
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+
+	alice := &User{
+		Username:     "Alice",
+		Email:        "alice@example.com",
+		PasswordHash: "alice-hash",
+		Role:         RoleAdmin,
+		CreatedAt:    now.Add(-time.Hour),
+		LastLogin:    now,
+	}
+	live := &Session{ID: "live", UserID: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), TokenHash: hashToken("live-token")}
+	stale := &Session{ID: "stale", UserID: "alice", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour), TokenHash: hashToken("stale-token")}
+
+	if err := store.PutUser(alice); err != nil {
+		t.Fatalf("PutUser: %v", err)
+	}
+	for _, session := range []*Session{live, stale} {
+		if err := store.PutSession(session); err != nil {
+			t.Fatalf("PutSession(%s): %v", session.ID, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.GetUser("alice")
+	if err != nil {
+		t.Fatalf("GetUser(alice): %v", err)
+	}
+	if *got != *alice {
+		t.Errorf("reopened user = %+v, want %+v", got, alice)
+	}
+
+	session, err := reopened.GetSession(live.TokenHash)
+	if err != nil {
+		t.Fatalf("GetSession(live): %v", err)
+	}
+	if *session != *live {
+		t.Errorf("reopened session = %+v, want %+v", session, live)
+	}
+	if _, err := reopened.GetSession(stale.TokenHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired session survived a reopen: %v", err)
+	}
+}
@@ -3,6 +3,11 @@ module canda-executor
 go 1.24.3
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/yuin/gopher-lua v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.3
+	github.com/yuin/gopher-lua v1.1.1
+)
+
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0 // indirect
 )
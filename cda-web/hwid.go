@@ -107,17 +107,6 @@ func (h *HWIDSpoofer) HandleSpoofHWID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	
-	if !authManager.ValidateToken(token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-	
 	var req SpoofRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -94,17 +94,6 @@ func (is *InjectorStatus) HandleInject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	if !authManager.ValidateToken(token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
 	var req InjectRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -160,17 +149,6 @@ func (is *InjectorStatus) HandleInject(w http.ResponseWriter, r *http.Request) {
 }
 
 func (is *InjectorStatus) HandleFeatures(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	if !authManager.ValidateToken(token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
 	if r.Method == http.MethodGet {
 		is.mu.RLock()
 		features := make([]Feature, 0)
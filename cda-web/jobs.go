@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusCancelled JobStatus = "cancelled"
+)
+
+const jobRetention = time.Hour
+
+type Job struct {
+	ID         string          `json:"id"`
+	Owner      string          `json:"owner"`
+	Status     JobStatus       `json:"status"`
+	Output     string          `json:"output"`
+	Lines      []OutputLine    `json:"lines"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	Results    []interface{}   `json:"results"`
+	Error      string          `json:"error,omitempty"`
+	ErrorCode  string          `json:"errorCode,omitempty"`
+	Details    *ExecutionError `json:"errorDetails,omitempty"`
+	PeakMemory int64           `json:"peakMemory"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+type JobResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Job     *Job   `json:"job,omitempty"`
+}
+
+type JobManager struct {
+	jobs    map[string]*Job
+	closed  bool
+	pending sync.WaitGroup
+	mu      sync.RWMutex
+}
+
+func NewJobManager() *JobManager {
+	return &JobManager{
+		jobs: make(map[string]*Job),
+	}
+}
+
+func (jm *JobManager) Submit(owner string, script string, opts ExecOptions) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	job := &Job{
+		ID:        generateID(),
+		Owner:     owner,
+		Status:    JobStatusQueued,
+		Lines:     make([]OutputLine, 0),
+		Results:   make([]interface{}, 0),
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	opts.JobID = job.ID
+	opts.ChunkName = "job:" + job.ID
+
+	jm.mu.Lock()
+	if jm.closed {
+		jm.mu.Unlock()
+		cancel()
+		return nil, ErrShuttingDown
+	}
+	jm.pruneLocked()
+	jm.jobs[job.ID] = job
+	snapshot := jm.snapshotLocked(job)
+	jm.pending.Add(1)
+	jm.mu.Unlock()
+
+	err := scheduler.Submit(owner, opts.sessionID(), func() {
+		defer jm.pending.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				jm.fail(job, ErrTaskPanicked)
+				panic(r)
+			}
+		}()
+		jm.run(ctx, job, script, opts)
+	})
+	if err != nil {
+		cancel()
+		jm.pending.Done()
+		jm.mu.Lock()
+		delete(jm.jobs, job.ID)
+		jm.mu.Unlock()
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (jm *JobManager) run(ctx context.Context, job *Job, script string, opts ExecOptions) {
+	defer job.cancel()
+
+	jm.mu.Lock()
+	if job.Status == JobStatusCancelled {
+		jm.mu.Unlock()
+		return
+	}
+	started := time.Now()
+	job.Status = JobStatusRunning
+	job.StartedAt = &started
+	jm.mu.Unlock()
+
+	if opts.Broadcast {
+		wsManager.BroadcastMessage("[Job " + job.ID + "] Started")
+	}
+
+	// Lines are recorded as they are printed so polling shows progress.
+	onOutput := opts.OnOutput
+	opts.OnOutput = func(line OutputLine) {
+		jm.mu.Lock()
+		job.Lines = append(job.Lines, line)
+		jm.mu.Unlock()
+		if onOutput != nil {
+			onOutput(line)
+		}
+	}
+
+	result, err := executeLuaScript(ctx, script, opts)
+
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	finished := time.Now()
+	job.FinishedAt = &finished
+	job.Output = result.Output
+	job.Truncated = result.Truncated
+	job.Results = result.Results
+	job.PeakMemory = result.PeakMemory
+
+	if err != nil {
+		job.Error = err.Error()
+		var execErr *ExecutionError
+		if errors.As(err, &execErr) {
+			job.ErrorCode = execErr.Kind
+			job.Details = execErr
+		}
+
+		if job.ErrorCode == ErrCodeCancelled {
+			job.Status = JobStatusCancelled
+		} else {
+			job.Status = JobStatusFailed
+		}
+		if opts.Broadcast {
+			wsManager.BroadcastError(job.ID, job.Details)
+		}
+		return
+	}
+
+	job.Status = JobStatusSucceeded
+	if opts.Broadcast {
+		wsManager.BroadcastMessage("[Job " + job.ID + "] Finished")
+	}
+}
+
+// fail marks a job that stopped without producing a result as failed.
+func (jm *JobManager) fail(job *Job, err error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	finished := time.Now()
+	job.FinishedAt = &finished
+	job.Status = JobStatusFailed
+	job.Error = err.Error()
+}
+
+// snapshotLocked copies job for a caller. While the job runs, its output is
+// assembled from the lines printed so far.
+func (jm *JobManager) snapshotLocked(job *Job) *Job {
+	snapshot := *job
+	if job.Status == JobStatusRunning {
+		texts := make([]string, 0, len(job.Lines))
+		for _, line := range job.Lines {
+			texts = append(texts, line.Text)
+		}
+		snapshot.Output = strings.Join(texts, "\n")
+	}
+	return &snapshot
+}
+
+// Get returns a copy of the job if it exists and belongs to owner.
+func (jm *JobManager) Get(id string, owner string) (*Job, bool) {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+
+	job, exists := jm.jobs[id]
+	if !exists || !strings.EqualFold(job.Owner, owner) {
+		return nil, false
+	}
+
+	return jm.snapshotLocked(job), true
+}
+
+func (jm *JobManager) Cancel(id string, owner string) (*Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists || !strings.EqualFold(job.Owner, owner) {
+		return nil, false
+	}
+
+	switch job.Status {
+	case JobStatusQueued:
+		finished := time.Now()
+		job.Status = JobStatusCancelled
+		job.FinishedAt = &finished
+		job.cancel()
+	case JobStatusRunning:
+		job.cancel()
+	}
+
+	return jm.snapshotLocked(job), true
+}
+
+// Shutdown refuses new jobs, cancels the queued ones and waits for running
+// jobs to finish. Jobs still running when ctx ends are cancelled.
+func (jm *JobManager) Shutdown(ctx context.Context) error {
+	jm.mu.Lock()
+	jm.closed = true
+	for _, job := range jm.jobs {
+		if job.Status == JobStatusQueued {
+			finished := time.Now()
+			job.Status = JobStatusCancelled
+			job.FinishedAt = &finished
+			job.cancel()
+		}
+	}
+	jm.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jm.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	jm.mu.Lock()
+	for _, job := range jm.jobs {
+		if job.Status == JobStatusRunning {
+			job.cancel()
+		}
+	}
+	jm.mu.Unlock()
+
+	<-done
+	return ctx.Err()
+}
+
+func (jm *JobManager) pruneLocked() {
+	cutoff := time.Now().Add(-jobRetention)
+	for id, job := range jm.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(jm.jobs, id)
+		}
+	}
+}
+
+func (jm *JobManager) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	user, req, ok := decodeExecuteRequest(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := resolveExecOptions(user, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	job, err := jm.Submit(user.Username, req.Script, opts)
+	if err == ErrSchedulerBusy {
+		writeBusy(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JobResponse{
+		Success: true,
+		Message: "Job queued",
+		Job:     job,
+	})
+}
+
+func (jm *JobManager) HandleJob(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	id := r.PathValue("id")
+
+	var job *Job
+	var exists bool
+	var message string
+
+	switch r.Method {
+	case http.MethodGet:
+		job, exists = jm.Get(id, user.Username)
+		message = "Job retrieved successfully"
+	case http.MethodDelete:
+		job, exists = jm.Cancel(id, user.Username)
+		message = "Job cancellation requested"
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JobResponse{
+		Success: true,
+		Message: message,
+		Job:     job,
+	})
+}
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	ErrCodeTimeout        = "timeout"
+	ErrCodeBudgetExceeded = "budget_exceeded"
+	ErrCodeCancelled      = "cancelled"
+	ErrCodeInvalidResult  = "invalid_result"
+)
+
+var errStepBudgetExceeded = errors.New("instruction budget exceeded")
+
+type ExecutionLimits struct {
+	Timeout         time.Duration `json:"timeout"`
+	MaxSteps        int64         `json:"maxSteps"`
+	MaxMemory       int64         `json:"maxMemory"`
+	CallStackSize   int           `json:"callStackSize"`
+	RegistryMaxSize int           `json:"registryMaxSize"`
+}
+
+type LimitsRegistry struct {
+	defaults ExecutionLimits
+	byRole   map[string]ExecutionLimits
+	mu       sync.RWMutex
+}
+
+func NewLimitsRegistry() *LimitsRegistry {
+	lr := &LimitsRegistry{
+		defaults: ExecutionLimits{
+			Timeout:         10 * time.Second,
+			MaxSteps:        50000000,
+			MaxMemory:       64 << 20,
+			CallStackSize:   200,
+			RegistryMaxSize: 256 * 1024,
+		},
+		byRole: make(map[string]ExecutionLimits),
+	}
+
+	return lr
+}
+
+// Configure applies per-role limits written as "timeout/steps[/memory]", e.g.
+// {"default": "10s/50000000/64MB", "admin": "60s/0"}. A step budget of 0
+// disables instruction counting for that role; the memory cap is optional
+// and keeps the default when omitted. The "default" entry is applied first
+// so other roles inherit from it.
+func (lr *LimitsRegistry) Configure(limits map[string]string) error {
+	if spec, exists := limits["default"]; exists {
+		parsed, err := parseLimitsSpec(lr.ForRole(""), spec)
+		if err != nil {
+			return fmt.Errorf("limits for default: %w", err)
+		}
+		lr.SetRoleLimits("default", parsed)
+	}
+
+	for role, spec := range limits {
+		role = strings.ToLower(strings.TrimSpace(role))
+		if role == "default" {
+			continue
+		}
+
+		parsed, err := parseLimitsSpec(lr.ForRole(""), spec)
+		if err != nil {
+			return fmt.Errorf("limits for %s: %w", role, err)
+		}
+		lr.SetRoleLimits(role, parsed)
+	}
+
+	return nil
+}
+
+func parseLimitsSpec(limits ExecutionLimits, spec string) (ExecutionLimits, error) {
+	values := strings.SplitN(strings.TrimSpace(spec), "/", 3)
+	if len(values) < 2 {
+		return limits, fmt.Errorf("expected timeout/steps[/memory]")
+	}
+
+	timeout, err := time.ParseDuration(values[0])
+	if err != nil {
+		return limits, err
+	}
+
+	steps, err := strconv.ParseInt(values[1], 10, 64)
+	if err != nil {
+		return limits, err
+	}
+
+	limits.Timeout = timeout
+	limits.MaxSteps = steps
+
+	if len(values) == 3 {
+		memory, err := parseByteSize(values[2])
+		if err != nil {
+			return limits, err
+		}
+		limits.MaxMemory = memory
+	}
+
+	return limits, nil
+}
+
+func (lr *LimitsRegistry) SetRoleLimits(role string, limits ExecutionLimits) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if role == "default" {
+		lr.defaults = limits
+		return
+	}
+	lr.byRole[role] = limits
+}
+
+func (lr *LimitsRegistry) ForRole(role string) ExecutionLimits {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+
+	if limits, exists := lr.byRole[role]; exists {
+		return limits
+	}
+	return lr.defaults
+}
+
+func (lr *LimitsRegistry) ForUser(user *User) ExecutionLimits {
+	if user == nil {
+		return lr.ForRole("")
+	}
+	return lr.ForRole(user.Role)
+}
+
+// budgetContext counts VM instructions. gopher-lua polls Done() once per
+// instruction when a context is set, so that is where the budget is charged
+// and where the memory meter is sampled.
+type budgetContext struct {
+	context.Context
+	cancel   context.CancelCauseFunc
+	steps    atomic.Int64
+	maxSteps int64
+	meter    *memoryMeter
+	// blocked is the last hidden global the script read, and blockedAt
+	// where it read it, so the error that follows can be reported as a
+	// sandbox violation.
+	blocked   string
+	blockedAt string
+}
+
+func newBudgetContext(parent context.Context, limits ExecutionLimits) (*budgetContext, context.CancelFunc) {
+	var stop context.CancelFunc = func() {}
+	if limits.Timeout > 0 {
+		parent, stop = context.WithTimeout(parent, limits.Timeout)
+	}
+
+	ctx, cancel := context.WithCancelCause(parent)
+	bc := &budgetContext{
+		Context:  ctx,
+		cancel:   cancel,
+		maxSteps: limits.MaxSteps,
+	}
+
+	return bc, func() {
+		cancel(context.Canceled)
+		stop()
+	}
+}
+
+func (bc *budgetContext) Done() <-chan struct{} {
+	steps := bc.steps.Add(1)
+	if bc.maxSteps > 0 && steps > bc.maxSteps {
+		bc.cancel(errStepBudgetExceeded)
+	}
+	if bc.meter != nil && bc.meter.check(steps) {
+		bc.cancel(errMemoryExceeded)
+	}
+	return bc.Context.Done()
+}
+
+func (bc *budgetContext) Err() error {
+	if bc.Context.Err() == nil {
+		return nil
+	}
+	return context.Cause(bc.Context)
+}
+
+// budgetOf returns the budget of the execution running in L, or nil.
+// Coroutines run in threads of their own, so the budget hangs off the main
+// one.
+func budgetOf(L *lua.LState) *budgetContext {
+	for L.Parent != nil {
+		L = L.Parent
+	}
+	budget, _ := L.Context().(*budgetContext)
+	return budget
+}
+
+func (bc *budgetContext) Steps() int64 {
+	return bc.steps.Load()
+}
+
+// limitError maps a stopped context to the structured error reported to
+// callers, or returns nil if the budget was not the reason the script ended.
+func (bc *budgetContext) limitError(limits ExecutionLimits, err error) *ExecutionError {
+	if bc.meter != nil && bc.meter.exceeded {
+		return &ExecutionError{
+			Kind:    ErrCodeMemoryExceeded,
+			Message: fmt.Sprintf("script exceeded %d byte memory limit", limits.MaxMemory),
+		}
+	}
+
+	switch bc.Err() {
+	case nil:
+		return nil
+	case errStepBudgetExceeded:
+		return &ExecutionError{
+			Kind:    ErrCodeBudgetExceeded,
+			Message: fmt.Sprintf("script exceeded %d instructions", limits.MaxSteps),
+		}
+	case context.DeadlineExceeded:
+		return &ExecutionError{
+			Kind:    ErrCodeTimeout,
+			Message: fmt.Sprintf("script exceeded %s wall-clock limit", limits.Timeout),
+		}
+	case context.Canceled:
+		return &ExecutionError{
+			Kind:    ErrCodeCancelled,
+			Message: "script was cancelled",
+		}
+	}
+	return nil
+}
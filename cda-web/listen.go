@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultBindAddr = "127.0.0.1"
+
+// ListenSettings controls where the listeners bind. BindAddr applies to both
+// the HTTP server and the TCP console; the socket paths add Unix domain
+// socket listeners next to them for local tools.
+type ListenSettings struct {
+	BindAddr   string `json:"bindAddr"`
+	HTTPSocket string `json:"httpSocket,omitempty"`
+	TCPSocket  string `json:"tcpSocket,omitempty"`
+}
+
+// IsLoopback reports whether BindAddr only accepts local connections.
+func (s ListenSettings) IsLoopback() bool {
+	if s.BindAddr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(s.BindAddr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenUnix listens on a Unix domain socket that only the current user can
+// connect to. The socket is created inside a private directory, restricted,
+// and only then moved to path, so nobody else can connect in between. A
+// socket file left behind by an earlier run is replaced, but one that another
+// process is still serving is not.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New(path + " is in use by another process")
+		}
+		os.Remove(path)
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is about to move, so removing it on close is left to
+	// unixListener.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	log.Printf("Listening on Unix socket %s", path)
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+// unixListener removes its socket file when closed.
+type unixListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var ErrSessionLimit = errors.New("session limit reached")
+
+// LuaSession is a long-lived Lua state owned by one user. Executions that
+// target it run one at a time and keep whatever globals earlier runs defined.
+type LuaSession struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	ProfileName string    `json:"profile"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Executions  int       `json:"executions"`
+
+	Profile *SandboxProfile `json:"-"`
+	limits  ExecutionLimits
+	state   *lua.LState
+	closed  bool
+	mu      sync.Mutex
+}
+
+type CreateSessionRequest struct {
+	Profile string `json:"profile,omitempty"`
+}
+
+type SessionResponse struct {
+	Success  bool          `json:"success"`
+	Message  string        `json:"message"`
+	Session  *LuaSession   `json:"session,omitempty"`
+	Sessions []*LuaSession `json:"sessions,omitempty"`
+}
+
+type LuaSessionManager struct {
+	sessions    map[string]*LuaSession
+	maxPerUser  int
+	idleTimeout time.Duration
+	mu          sync.RWMutex
+}
+
+func NewLuaSessionManager(maxPerUser int, idleTimeout time.Duration) *LuaSessionManager {
+	sm := &LuaSessionManager{
+		sessions:    make(map[string]*LuaSession),
+		maxPerUser:  maxPerUser,
+		idleTimeout: idleTimeout,
+	}
+
+	go sm.sweep()
+
+	return sm
+}
+
+func (sm *LuaSessionManager) Create(owner string, profile *SandboxProfile, limits ExecutionLimits) (*LuaSession, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	count := 0
+	for _, session := range sm.sessions {
+		if strings.EqualFold(session.Owner, owner) {
+			count++
+		}
+	}
+	if count >= sm.maxPerUser {
+		return nil, ErrSessionLimit
+	}
+
+	session := newLuaSession(owner, profile, limits)
+	sm.sessions[session.ID] = session
+
+	log.Printf("Lua session %s created for %s", session.ID, owner)
+
+	return session, nil
+}
+
+func (sm *LuaSessionManager) Get(id string, owner string) (*LuaSession, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, exists := sm.sessions[id]
+	if !exists || !strings.EqualFold(session.Owner, owner) {
+		return nil, false
+	}
+	return session, true
+}
+
+func (sm *LuaSessionManager) List(owner string) []*LuaSession {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sessions := make([]*LuaSession, 0)
+	for _, session := range sm.sessions {
+		if strings.EqualFold(session.Owner, owner) {
+			sessions = append(sessions, session.snapshot())
+		}
+	}
+	return sessions
+}
+
+func (sm *LuaSessionManager) Close(id string, owner string) bool {
+	sm.mu.Lock()
+	session, exists := sm.sessions[id]
+	if !exists || !strings.EqualFold(session.Owner, owner) {
+		sm.mu.Unlock()
+		return false
+	}
+	delete(sm.sessions, id)
+	sm.mu.Unlock()
+
+	session.Close()
+	log.Printf("Lua session %s closed", id)
+	return true
+}
+
+// CloseAll closes every session, for shutdown.
+func (sm *LuaSessionManager) CloseAll() {
+	sm.mu.Lock()
+	sessions := sm.sessions
+	sm.sessions = make(map[string]*LuaSession)
+	sm.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+	if len(sessions) > 0 {
+		log.Printf("Closed %d Lua sessions", len(sessions))
+	}
+}
+
+func (sm *LuaSessionManager) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-sm.idleTimeout)
+		expired := make([]*LuaSession, 0)
+
+		sm.mu.Lock()
+		for id, session := range sm.sessions {
+			if !session.mu.TryLock() {
+				continue
+			}
+			idle := session.LastUsed.Before(cutoff)
+			session.mu.Unlock()
+
+			if idle {
+				delete(sm.sessions, id)
+				expired = append(expired, session)
+			}
+		}
+		sm.mu.Unlock()
+
+		for _, session := range expired {
+			session.Close()
+			log.Printf("Lua session %s expired after %s idle", session.ID, sm.idleTimeout)
+		}
+	}
+}
+
+// newLuaSession creates a session that is not tracked by any manager; the
+// caller is responsible for closing it.
+func newLuaSession(owner string, profile *SandboxProfile, limits ExecutionLimits) *LuaSession {
+	now := time.Now()
+	return &LuaSession{
+		ID:          generateID(),
+		Owner:       owner,
+		ProfileName: profile.Name,
+		CreatedAt:   now,
+		LastUsed:    now,
+		Profile:     profile,
+		limits:      limits,
+		state:       profile.NewState(limits),
+	}
+}
+
+func (s *LuaSession) Execute(ctx context.Context, script string, opts ExecOptions) (*ExecResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return emptyExecResult(), &ExecutionError{Kind: ErrCodeRuntime, Message: "session is closed"}
+	}
+
+	s.LastUsed = time.Now()
+	s.Executions++
+
+	if opts.ChunkName == "" {
+		opts.ChunkName = "session:" + s.ID
+	}
+
+	return runLuaChunk(ctx, s.state, script, opts)
+}
+
+func (s *LuaSession) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.state.Close()
+	s.state = s.Profile.NewState(s.limits)
+	s.LastUsed = time.Now()
+	s.Executions = 0
+}
+
+func (s *LuaSession) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.state.Close()
+		s.closed = true
+	}
+}
+
+func (s *LuaSession) snapshot() *LuaSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &LuaSession{
+		ID:          s.ID,
+		Owner:       s.Owner,
+		ProfileName: s.ProfileName,
+		CreatedAt:   s.CreatedAt,
+		LastUsed:    s.LastUsed,
+		Executions:  s.Executions,
+	}
+}
+
+func (sm *LuaSessionManager) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SessionResponse{
+			Success:  true,
+			Message:  "Sessions retrieved successfully",
+			Sessions: sm.List(user.Username),
+		})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req CreateSessionRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		profile, err := sandbox.Resolve(user, req.Profile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		session, err := sm.Create(user.Username, profile, execLimits.ForUser(user))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(SessionResponse{
+			Success: true,
+			Message: "Session created",
+			Session: session.snapshot(),
+		})
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func (sm *LuaSessionManager) HandleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+
+	session, exists := sm.Get(r.PathValue("id"), user.Username)
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SessionResponse{
+		Success: true,
+		Message: "Session retrieved successfully",
+		Session: session.snapshot(),
+	})
+}
+
+// HandleSessionAction serves POST /sessions/{id}/reset and
+// POST /sessions/{id}/close.
+func (sm *LuaSessionManager) HandleSessionAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+
+	id := r.PathValue("id")
+	session, exists := sm.Get(id, user.Username)
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	response := SessionResponse{Success: true}
+
+	switch r.PathValue("action") {
+	case "reset":
+		session.Reset()
+		response.Message = "Session reset"
+		response.Session = session.snapshot()
+	case "close":
+		sm.Close(id, user.Username)
+		response.Message = "Session closed"
+	default:
+		http.Error(w, "Unknown session action", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,27 +1,79 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
 type ExecuteRequest struct {
-	Script string `json:"script"`
+	Script    string `json:"script"`
+	Profile   string `json:"profile,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	Broadcast bool   `json:"broadcast,omitempty"`
 }
 
 type ExecuteResponse struct {
-	Output string `json:"output"`
-	Error  string `json:"error,omitempty"`
+	Output      string            `json:"output"`
+	Lines       []OutputLine      `json:"lines"`
+	Truncated   bool              `json:"truncated,omitempty"`
+	Results     []interface{}     `json:"results"`
+	Error       string            `json:"error,omitempty"`
+	ErrorCode   string            `json:"errorCode,omitempty"`
+	Details     *ExecutionError   `json:"errorDetails,omitempty"`
+	Diagnostics []*ExecutionError `json:"diagnostics,omitempty"`
+	PeakMemory  int64             `json:"peakMemory"`
 }
 
+type ExecOptions struct {
+	Profile *SandboxProfile
+	Limits  ExecutionLimits
+	JobID   string
+	// Source names who ran the script in broadcast output, e.g. "TCP alice".
+	Source    string
+	ChunkName string
+	Broadcast bool
+	Session   *LuaSession
+	// OnOutput, if set, receives each printed line as it is written.
+	OnOutput func(OutputLine)
+	// TextResults renders return values with tostring instead of converting
+	// them to JSON, for consoles that just display them.
+	TextResults bool
+}
+
+// sessionID is the ID of the Lua session opts executes in, for the
+// scheduler, or empty if it uses a fresh state.
+func (opts ExecOptions) sessionID() string {
+	if opts.Session == nil {
+		return ""
+	}
+	return opts.Session.ID
+}
+
+type ExecResult struct {
+	Output     string
+	Lines      []OutputLine
+	Truncated  bool
+	Results    []interface{}
+	Display    []string
+	PeakMemory int64
+}
+
+const defaultChunkName = "script"
+
 var (
 	wsManager      *WebSocketManager
 	portManager    *PortManager
@@ -29,81 +81,280 @@ var (
 	authManager    *AuthManager
 	injectorStatus *InjectorStatus
 	hwid           *HWIDSpoofer
+	sandbox        *SandboxRegistry
+	execLimits     *LimitsRegistry
+	jobManager     *JobManager
+	scheduler      *Scheduler
+	luaSessions    *LuaSessionManager
+	tcpAuth        *TCPAuthenticator
+	tlsConfig      *tls.Config
+	tcpConsole     *tcpServer
 )
 
-func executeLuaScript(script string) (string, error) {
-	L := lua.NewState()
+// emptyExecResult is the result of an execution that never ran. Its slices
+// are empty rather than nil so it serialises like any other result.
+func emptyExecResult() *ExecResult {
+	return &ExecResult{
+		Lines:   make([]OutputLine, 0),
+		Results: make([]interface{}, 0),
+	}
+}
+
+func executeLuaScript(ctx context.Context, script string, opts ExecOptions) (*ExecResult, error) {
+	if opts.Session != nil {
+		return opts.Session.Execute(ctx, script, opts)
+	}
+
+	L := opts.Profile.NewState(opts.Limits)
 	defer L.Close()
 
+	return runLuaChunk(ctx, L, script, opts)
+}
+
+// runLuaChunk runs script on an existing state under the budgets in opts and
+// leaves the state's stack as it found it, so it works for both one-shot
+// states and long-lived sessions.
+func runLuaChunk(ctx context.Context, L *lua.LState, script string, opts ExecOptions) (*ExecResult, error) {
+	budget, cancel := newBudgetContext(ctx, opts.Limits)
+	defer cancel()
+	budget.meter = newMemoryMeter(L, opts.Limits.MaxMemory)
+	L.SetContext(budget)
+	defer L.RemoveContext()
+
+	prefix := ""
+	if opts.JobID != "" {
+		prefix = "[Job " + opts.JobID + "] "
+	} else if opts.Source != "" {
+		prefix = "[" + opts.Source + "] "
+	}
+	output := newOutputBuffer(func(line OutputLine) {
+		if opts.Broadcast {
+			wsManager.BroadcastMessage(prefix + line.Text)
+		}
+		if opts.OnOutput != nil {
+			opts.OnOutput(line)
+		}
+	})
+
 	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
 		args := make([]string, 0, L.GetTop())
 		for i := 1; i <= L.GetTop(); i++ {
-			args = append(args, L.Get(i).String())
-		}
-		for _, arg := range args {
-			wsManager.BroadcastMessage(arg)
+			args = append(args, L.ToStringMeta(L.Get(i)).String())
 		}
+		output.WriteLine(strings.Join(args, "\t"))
 		return 0
 	}))
 
-	err := L.DoString(script)
+	chunk := opts.ChunkName
+	if chunk == "" {
+		chunk = defaultChunkName
+	}
+
+	base := L.GetTop()
+	defer L.SetTop(base)
+
+	fn, err := L.Load(strings.NewReader(script), chunk)
+	if err == nil {
+		L.Push(fn)
+		err = L.PCall(0, lua.MultRet, nil)
+	}
+	budget.meter.sample(budget.Steps())
+
+	result := &ExecResult{
+		Output:     output.String(),
+		Lines:      output.Lines(),
+		Truncated:  output.Truncated(),
+		Results:    make([]interface{}, 0),
+		PeakMemory: budget.meter.Peak(),
+	}
+
 	if err != nil {
-		return "", err
+		execErr := classifyError(err, chunk, script)
+		if limitErr := budget.limitError(opts.Limits, err); limitErr != nil {
+			limitErr.Chunk = execErr.Chunk
+			limitErr.Line = execErr.Line
+			limitErr.Traceback = execErr.Traceback
+			execErr = limitErr
+		} else {
+			opts.Profile.blockedUse(budget, execErr)
+		}
+		return result, execErr
 	}
 
-	return "Script executed successfully", nil
+	for i := base + 1; i <= L.GetTop(); i++ {
+		if opts.TextResults {
+			result.Display = append(result.Display, L.ToStringMeta(L.Get(i)).String())
+			continue
+		}
+
+		value, err := luaToJSON(L.Get(i))
+		if err != nil {
+			return result, &ExecutionError{
+				Kind:    ErrCodeInvalidResult,
+				Chunk:   chunk,
+				Message: fmt.Sprintf("return value %d: %v", i-base, err),
+			}
+		}
+		result.Results = append(result.Results, value)
+	}
+
+	return result, nil
 }
 
-func handleExecute(w http.ResponseWriter, r *http.Request) {
+func resolveExecOptions(user *User, req ExecuteRequest) (ExecOptions, error) {
+	opts := ExecOptions{
+		Limits:    execLimits.ForUser(user),
+		Broadcast: req.Broadcast,
+	}
+
+	if req.SessionID != "" {
+		session, exists := luaSessions.Get(req.SessionID, user.Username)
+		if !exists {
+			return opts, fmt.Errorf("unknown session: %s", req.SessionID)
+		}
+		opts.Session = session
+		opts.Profile = session.Profile
+		return opts, nil
+	}
+
+	profile, err := sandbox.Resolve(user, req.Profile)
+	if err != nil {
+		return opts, err
+	}
+	opts.Profile = profile
+
+	return opts, nil
+}
+
+// decodeExecuteRequest performs the method and body checks shared by every
+// endpoint that accepts an ExecuteRequest, and returns the caller.
+func decodeExecuteRequest(w http.ResponseWriter, r *http.Request) (*User, ExecuteRequest, bool) {
+	var req ExecuteRequest
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil, req, false
 	}
 
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, req, false
+	}
+
+	return requestUser(r), req, true
+}
+
+func handleExecute(w http.ResponseWriter, r *http.Request) {
+	user, req, ok := decodeExecuteRequest(w, r)
+	if !ok {
 		return
 	}
 
-	if !authManager.ValidateToken(token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	opts, err := resolveExecOptions(user, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	var req ExecuteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	var result *ExecResult
+	schedErr := scheduler.Run(r.Context(), user.Username, opts.sessionID(), func() {
+		result, err = executeLuaScript(r.Context(), req.Script, opts)
+	})
+	if schedErr == ErrSchedulerBusy {
+		writeBusy(w)
+		return
+	}
+	if schedErr == ErrTaskPanicked {
+		http.Error(w, schedErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if schedErr != nil {
+		// Shutting down, or the client gave up while the script was queued.
+		http.Error(w, schedErr.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	output, err := executeLuaScript(req.Script)
-	resp := ExecuteResponse{Output: output}
+	resp := ExecuteResponse{
+		Output:     result.Output,
+		Lines:      result.Lines,
+		Truncated:  result.Truncated,
+		Results:    result.Results,
+		PeakMemory: result.PeakMemory,
+	}
 
 	if err != nil {
 		resp.Error = err.Error()
-		wsManager.BroadcastMessage("[Error] " + err.Error())
+		var execErr *ExecutionError
+		if errors.As(err, &execErr) {
+			resp.ErrorCode = execErr.Kind
+			resp.Details = execErr
+		}
+		if opts.Broadcast {
+			wsManager.BroadcastError("", execErr)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleValidate(w http.ResponseWriter, r *http.Request) {
+	_, req, ok := decodeExecuteRequest(w, r)
+	if !ok {
+		return
+	}
+
+	resp := ExecuteResponse{
+		Lines:       make([]OutputLine, 0),
+		Results:     make([]interface{}, 0),
+		Diagnostics: validateLuaScript(req.Script, defaultChunkName),
+	}
+
+	if len(resp.Diagnostics) > 0 {
+		first := resp.Diagnostics[0]
+		resp.Error = first.Error()
+		resp.ErrorCode = first.Kind
+		resp.Details = first
+	} else {
+		resp.Output = "No syntax errors"
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+func writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(schedulerRetryAfter))
+	http.Error(w, ErrSchedulerBusy.Error(), http.StatusTooManyRequests)
+}
+
+// getPortStatus is public so clients can find the server before signing in;
+// hardware identifiers are only included for signed-in callers.
 func getPortStatus(w http.ResponseWriter, r *http.Request) {
+	status := portManager.Snapshot()
+	response := map[string]interface{}{
+		"port":            status.Port,
+		"status":          status.Status,
+		"lastError":       status.LastError,
+		"statusChangedAt": status.ChangedAt,
+		"tcpPort":         tcpPort,
+		"injectorStatus":  injectorStatus.GetStatus(),
+		"scheduler":       scheduler.Stats(),
+		"tls":             tlsConfig != nil,
+		"version":         version,
+	}
+	if requestUser(r) != nil {
+		response["hwid"] = hwid.GetCurrentHWID()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"port":           portManager.GetCurrentPort(),
-		"status":         portManager.GetStatus(),
-		"tcpPort":        tcpPort,
-		"injectorStatus": injectorStatus.GetStatus(),
-		"hwid":           hwid.GetCurrentHWID(),
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == http.MethodOptions {
@@ -115,115 +366,179 @@ func enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func handleTCPConnection(conn net.Conn) {
-	defer conn.Close()
+func main() {
+	startedAt := time.Now()
 
-	clientAddr := conn.RemoteAddr().String()
-	log.Printf("TCP client connected: %s", clientAddr)
-	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client connected: %s", clientAddr))
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
 
-	conn.Write([]byte("Connected to Canda executor TCP server\n"))
+	wsManager = NewWebSocketManager(cfg.WebSocket)
 
-	buffer := make([]byte, 1024)
+	portManager = NewPortManager(cfg)
+	listener, err := portManager.Listen()
+	if err != nil {
+		log.Fatalf("Failed to find available port: %v", err)
+	}
+	selectedPort := portManager.GetCurrentPort()
+
+	authStore, err := openAuthStore(cfg.Auth)
+	if err != nil {
+		log.Fatalf("Failed to open auth store: %v", err)
+	}
+	authManager = NewAuthManager(cfg.Auth, authStore)
+	if err := authManager.EnsureAdmin(cfg.Auth.AdminUser, cfg.Auth.AdminPassword); err != nil {
+		log.Fatalf("Failed to set up the admin account: %v", err)
+	}
+	injectorStatus = NewInjectorStatus()
+	hwid = NewHWIDSpoofer()
+	sandbox = NewSandboxRegistry()
+	if err := sandbox.Configure(cfg.Sandbox); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	execLimits = NewLimitsRegistry()
+	if err := execLimits.Configure(cfg.Limits); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	jobManager = NewJobManager()
+	scheduler = NewScheduler(cfg.Scheduler.Workers, cfg.Scheduler.QueueSize, cfg.Scheduler.QueuePerUser, cfg.Scheduler.PerUser)
+	luaSessions = NewLuaSessionManager(cfg.LuaSessions.MaxPerUser, time.Duration(cfg.LuaSessions.IdleTimeout))
+	tcpAuth = NewTCPAuthenticator(cfg.TCP, cfg.TLS)
+
+	routes := []Route{
+		{"/ws", Viewers, wsManager.HandleWebSocket},
+		{"/port-status", Public, getPortStatus},
+		{"/register", Public, authManager.HandleRegister},
+		{"/login", Public, authManager.HandleLogin},
+		{"/logout", Authenticated, authManager.HandleLogout},
+		{"/refresh", Authenticated, authManager.HandleRefresh},
+		// Login sessions live under /auth, apart from the Lua sessions
+		// under /sessions, so the two kinds of ID never share a path.
+		{"GET /auth/sessions", Authenticated, authManager.HandleMySessions},
+		{"DELETE /auth/sessions/{id}", Authenticated, authManager.HandleRevokeSession},
+		{"/execute", Operators, handleExecute},
+		{"/validate", Authenticated, handleValidate},
+		{"/jobs", Operators, jobManager.HandleJobs},
+		{"/jobs/{id}", Operators, jobManager.HandleJob},
+		{"/sessions", Operators, luaSessions.HandleSessions},
+		{"/sessions/{id}", Operators, luaSessions.HandleSession},
+		{"/sessions/{id}/{action}", Operators, luaSessions.HandleSessionAction},
+		{"/inject", Operators, injectorStatus.HandleInject},
+		{"/spoof-hwid", Operators, hwid.HandleSpoofHWID},
+		{"/features", Operators, injectorStatus.HandleFeatures},
+		{"GET /admin/users", Admins, authManager.HandleListUsers},
+		{"POST /admin/users/{username}/role", Admins, authManager.HandleSetRole},
+	}
+	for _, route := range routes {
+		http.Handle(route.Pattern, authManager.Middleware(route.Policy, route.Handler))
+	}
 
-	for {
-		conn.SetReadDeadline(time.Now().Add(1 * time.Hour))
+	corsHandler := enableCORS(http.DefaultServeMux)
 
-		n, err := conn.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("TCP client disconnected: %s", clientAddr)
-				wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client disconnected: %s", clientAddr))
-			} else {
-				log.Printf("Error reading from TCP client: %v", err)
-				wsManager.BroadcastMessage(fmt.Sprintf("[Error] TCP read error: %v", err))
-			}
-			break
-		}
+	tlsConfig, err = cfg.TLS.ServerConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	tcpTLSConfig, err := cfg.TLS.TCPConfig(tlsConfig)
+	if err != nil {
+		log.Fatalf("Failed to configure TCP TLS: %v", err)
+	}
 
-		data := string(buffer[:n])
-		data = strings.TrimSpace(data)
+	if !cfg.Listen.IsLoopback() && tlsConfig == nil {
+		log.Printf("Warning: listening on %s without TLS; tokens will cross the network in the clear", cfg.Listen.BindAddr)
+	}
 
-		log.Printf("Received from TCP client: %s", data)
-		wsManager.BroadcastMessage(fmt.Sprintf("[TCP] %s", data))
+	if err := startTCPServer(cfg, tcpTLSConfig); err != nil {
+		portManager.SetStatus(PortStatusDegraded, err)
+	}
 
-		if strings.HasPrefix(data, "EXEC:") {
-			script := strings.TrimPrefix(data, "EXEC:")
-			output, err := executeLuaScript(script)
+	log.Printf("Canda executor HTTP server starting on %s (TLS: %t)", listener.Addr(), tlsConfig != nil)
 
-			if err != nil {
-				conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
-				wsManager.BroadcastMessage(fmt.Sprintf("[Error] %v", err))
-			} else {
-				conn.Write([]byte(fmt.Sprintf("Success: %s\n", output)))
-				wsManager.BroadcastMessage(fmt.Sprintf("[Execution] %s", output))
-			}
+	wsManager.BroadcastMessage("[System] HTTP server started on port " + selectedPort)
+
+	// Requests run under a context that shutdown cancels if they outlast
+	// the deadline.
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	server := &http.Server{
+		Handler:   corsHandler,
+		TLSConfig: tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return requestCtx
+		},
+	}
+	servers := []*http.Server{server}
+
+	if cfg.Listen.HTTPSocket != "" {
+		socket, err := listenUnix(cfg.Listen.HTTPSocket)
+		if err != nil {
+			portManager.SetStatus(PortStatusDegraded, fmt.Errorf("HTTP socket: %w", err))
 		} else {
-			conn.Write([]byte(fmt.Sprintf("Echo: %s\n", data)))
+			go server.Serve(socket)
 		}
 	}
-}
 
-func startTCPServer(port int) {
-	tcpPort = port
-	addr := fmt.Sprintf(":%d", port)
+	httpPort, _ := strconv.Atoi(selectedPort)
+	discovery := newDiscoveryInfo(cfg, httpPort, startedAt)
 
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Printf("Failed to start TCP server: %v", err)
-		return
+	if cfg.Discovery.File != "" {
+		if err := writeDiscoveryFile(cfg.Discovery.File, discovery); err != nil {
+			log.Printf("Failed to write discovery file: %v", err)
+		} else {
+			log.Printf("Discovery file written to %s", cfg.Discovery.File)
+			defer removeDiscoveryFile(cfg.Discovery.File)
+		}
 	}
 
-	log.Printf("TCP server started on port %d", port)
-	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP server started on port %d", port))
+	if cfg.Discovery.BootstrapPort != 0 {
+		addr := net.JoinHostPort(cfg.Listen.BindAddr, strconv.Itoa(cfg.Discovery.BootstrapPort))
+		bootstrap, err := startBootstrapServer(addr, discovery)
+		if err != nil {
+			portManager.SetStatus(PortStatusDegraded, fmt.Errorf("bootstrap endpoint: %w", err))
+		} else {
+			servers = append(servers, bootstrap)
+		}
+	}
 
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("Error accepting TCP connection: %v", err)
-				continue
-			}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-			go handleTCPConnection(conn)
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			serveErr <- server.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- server.Serve(listener)
 		}
 	}()
-}
 
-func main() {
-	portManager = NewPortManager([]int{8080, 8081, 8082, 8083, 8084})
-	selectedPort, err := portManager.FindAvailablePort()
-	if err != nil {
-		log.Fatalf("Failed to find available port: %v", err)
+	select {
+	case err := <-serveErr:
+		portManager.SetStatus(PortStatusFailed, err)
+		if cfg.Discovery.File != "" {
+			removeDiscoveryFile(cfg.Discovery.File)
+		}
+		log.Fatalf("Error starting server: %v", err)
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down (send it again to exit immediately)", sig)
 	}
 
-	wsManager = NewWebSocketManager()
-	authManager = NewAuthManager()
-	injectorStatus = NewInjectorStatus()
-	hwid = NewHWIDSpoofer()
-
-	http.HandleFunc("/ws", wsManager.HandleWebSocket)
-	http.HandleFunc("/execute", handleExecute)
-	http.HandleFunc("/port-status", getPortStatus)
-	http.HandleFunc("/register", authManager.HandleRegister)
-	http.HandleFunc("/login", authManager.HandleLogin)
-	http.HandleFunc("/inject", injectorStatus.HandleInject)
-	http.HandleFunc("/spoof-hwid", hwid.HandleSpoofHWID)
-	http.HandleFunc("/features", injectorStatus.HandleFeatures)
-
-	corsHandler := enableCORS(http.DefaultServeMux)
-
-	startTCPServer(9000)
-
-	addr := ":" + selectedPort
-	log.Printf("Canda executor HTTP server starting on %s", addr)
+	go func() {
+		<-signals
+		log.Printf("Exiting without waiting for shutdown")
+		if cfg.Discovery.File != "" {
+			removeDiscoveryFile(cfg.Discovery.File)
+		}
+		os.Exit(1)
+	}()
 
-	wsManager.BroadcastMessage("[System] HTTP server started on port " + selectedPort)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
 
-	portManager.SetStatus(PortStatusConnected)
+	shutdown(ctx, servers, cancelRequests)
 
-	if err := http.ListenAndServe(addr, corsHandler); err != nil {
-		log.Fatalf("Error starting server: %v", err)
-		portManager.SetStatus(PortStatusFailed)
-	}
+	portManager.SetStatus(PortStatusStopped, nil)
+	log.Printf("Shutdown complete")
 }
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+const ErrCodeMemoryExceeded = "memory_exceeded"
+
+const (
+	memorySampleMinSteps = 100000
+	memorySampleFloor    = 1000
+	memoryTrackedString  = 256
+	memoryTableOverhead  = 56
+	memorySlotSize       = 16
+	memoryStringOverhead = 16
+	memoryFuncOverhead   = 64
+)
+
+var errMemoryExceeded = errors.New("memory limit exceeded")
+
+// memoryMeter estimates how much memory a Lua state holds by walking
+// everything reachable from its globals, registry and live call frames.
+// gopher-lua has no allocation hooks, so the walk runs periodically between
+// instructions. A walk is never started before the script has done as much
+// work as the last one cost: an instruction, or memoryStringOverhead bytes
+// charged, per value walked. That keeps metering linear in the script's own
+// work, at the price of letting the state overshoot the limit by up to about
+// its own size before a walk catches it.
+//
+// Strings can grow far faster than that, doubling with every concatenation,
+// so between walks the meter also charges strings as they show up in the
+// running function's registers and charges the string builtins that build
+// large results before they allocate them.
+type memoryMeter struct {
+	L          *lua.LState
+	maxBytes   int64
+	used       int64
+	pending    int64
+	peak       int64
+	exceeded   bool
+	steps      int64
+	nextSample int64
+	sampledAt  int64
+	walked     int64
+	visited    map[interface{}]struct{}
+	counted    map[*byte]struct{}
+	registers  []*byte
+}
+
+func newMemoryMeter(L *lua.LState, maxBytes int64) *memoryMeter {
+	return &memoryMeter{
+		L:          L,
+		maxBytes:   maxBytes,
+		nextSample: memorySampleMinSteps,
+		counted:    make(map[*byte]struct{}),
+	}
+}
+
+func (m *memoryMeter) Peak() int64 {
+	return m.peak
+}
+
+// check runs between instructions and reports whether the state is over
+// the limit. Every other call it also scans the running function's
+// registers, which is often enough to see every string a concatenation
+// builds: either its operands are in the registers just before it runs or
+// its result is just after. Those strings are charged, and the limit is
+// enforced on their total, since one concatenation may copy them all.
+func (m *memoryMeter) check(steps int64) bool {
+	m.steps = steps
+	if m.exceeded {
+		return true
+	}
+	if steps >= m.nextSample {
+		return m.sample(steps)
+	}
+	if m.maxBytes <= 0 || steps%2 != 0 {
+		return false
+	}
+
+	L := m.L
+	frame := 0
+	for i, top := 1, L.GetTop(); i <= top; i++ {
+		if str, ok := L.Get(i).(lua.LString); ok && str != "" {
+			frame += len(str)
+			if len(str) >= memoryTrackedString {
+				m.charge(i, str)
+			}
+		}
+	}
+	if int64(frame) > m.maxBytes {
+		m.exceeded = true
+		return true
+	}
+
+	if m.used+m.pending > m.maxBytes && m.affordable(0) {
+		return m.sample(steps)
+	}
+	return false
+}
+
+// affordable reports whether the script has done enough work since the last
+// sample, counting extra bytes about to be allocated, to pay for another.
+func (m *memoryMeter) affordable(extra int64) bool {
+	work := m.steps - m.sampledAt + (m.pending+extra)/memoryStringOverhead
+	return work >= m.walked
+}
+
+// charge adds str, found in register i, to the bytes allocated since the
+// last sample unless it has been counted already.
+func (m *memoryMeter) charge(i int, str lua.LString) {
+	data := unsafe.StringData(string(str))
+	if i < len(m.registers) && m.registers[i] == data {
+		return
+	}
+	for len(m.registers) <= i {
+		m.registers = append(m.registers, nil)
+	}
+	m.registers[i] = data
+
+	if _, ok := m.counted[data]; ok {
+		return
+	}
+	m.counted[data] = struct{}{}
+	m.pending += memoryStringOverhead + int64(len(str))
+}
+
+// reserve charges n bytes a builtin is about to allocate, or raises a memory
+// error in L if they would take the state over the limit. A nil meter
+// reserves nothing.
+func (m *memoryMeter) reserve(L *lua.LState, n int64) {
+	if m == nil || m.maxBytes <= 0 {
+		return
+	}
+	m.require(L, n)
+	m.pending += n
+}
+
+// require raises a memory error in L unless the state has room for n more
+// bytes, without charging them. It is for memory a builtin holds outside
+// the state, which a sample would not see.
+func (m *memoryMeter) require(L *lua.LState, n int64) {
+	if m == nil || m.maxBytes <= 0 {
+		return
+	}
+	if m.used+m.pending+n > m.maxBytes && m.affordable(n) {
+		// The estimate only grows between samples; take a fresh one before
+		// refusing in case most of it has become garbage.
+		m.sample(m.steps)
+		if m.used+n > m.maxBytes {
+			m.exceeded = true
+		}
+	}
+	if m.exceeded {
+		L.RaiseError("%s", errMemoryExceeded.Error())
+	}
+}
+
+// refuse raises an error in L for an allocation too large to ever succeed:
+// a memory error when there is a limit, a plain one otherwise.
+func (m *memoryMeter) refuse(L *lua.LState) {
+	if m != nil && m.maxBytes > 0 {
+		m.exceeded = true
+		L.RaiseError("%s", errMemoryExceeded.Error())
+	}
+	L.RaiseError("resulting string too large")
+}
+
+// sample measures the state and reports whether it is over the limit.
+func (m *memoryMeter) sample(steps int64) bool {
+	m.visited = make(map[interface{}]struct{})
+	m.counted = make(map[*byte]struct{})
+	m.registers = m.registers[:0]
+	m.sampledAt = steps
+	m.walked = 0
+	m.used = m.measureState()
+	m.pending = 0
+	m.visited = nil
+
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+
+	interval := int64(memorySampleMinSteps)
+	if m.maxBytes > 0 {
+		// Strings too short to be charged one by one still add up, so
+		// sample often enough that they cannot carry the state far past
+		// the limit, but never more often than the walk can be paid for.
+		headroom := (m.maxBytes - m.used) / (memoryStringOverhead + memoryTrackedString)
+		interval = min(interval, max(headroom, memorySampleFloor))
+	}
+	interval = max(interval, m.walked)
+	m.nextSample = steps + interval
+
+	if m.maxBytes > 0 && m.used > m.maxBytes {
+		m.exceeded = true
+	}
+	return m.exceeded
+}
+
+func (m *memoryMeter) measureState() int64 {
+	L := m.L
+	used := m.measure(L.G.Global) + m.measure(L.G.Registry)
+
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		for n := 1; ; n++ {
+			name, value := L.GetLocal(dbg, n)
+			if name == "" {
+				break
+			}
+			used += memorySlotSize + m.measure(value)
+		}
+	}
+
+	return used
+}
+
+func (m *memoryMeter) measure(value lua.LValue) int64 {
+	m.walked++
+	switch v := value.(type) {
+	case lua.LString:
+		if len(v) >= memoryTrackedString {
+			m.counted[unsafe.StringData(string(v))] = struct{}{}
+		}
+		return memoryStringOverhead + int64(len(v))
+	case *lua.LTable:
+		if m.seen(v) {
+			return 0
+		}
+		size := int64(memoryTableOverhead)
+		v.ForEach(func(key, val lua.LValue) {
+			size += 2*memorySlotSize + m.measure(key) + m.measure(val)
+		})
+		if mt, ok := v.Metatable.(*lua.LTable); ok {
+			size += m.measure(mt)
+		}
+		return size
+	case *lua.LFunction:
+		if m.seen(v) {
+			return 0
+		}
+		size := int64(memoryFuncOverhead)
+		for _, uv := range v.Upvalues {
+			size += memorySlotSize + m.measure(uv.Value())
+		}
+		return size
+	case *lua.LUserData:
+		if m.seen(v) {
+			return 0
+		}
+		return memoryFuncOverhead + m.measure(v.Metatable)
+	}
+	return 0
+}
+
+func (m *memoryMeter) seen(key interface{}) bool {
+	if _, ok := m.visited[key]; ok {
+		return true
+	}
+	m.visited[key] = struct{}{}
+	return false
+}
+
+// installMemoryGuards replaces the builtins that can build an arbitrarily
+// large string in a single call with versions that reserve the result with
+// the running execution's meter first. It is done once per state; the meter
+// is looked up on each call, since sessions run many executions on a state.
+func installMemoryGuards(L *lua.LState) {
+	if strlib, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		strlib.RawSetString("rep", L.NewFunction(stringRep))
+		strlib.RawSetString("format", L.NewFunction(guardBuiltin(strlib.RawGetString("format"), formatSize)))
+		strlib.RawSetString("gsub", L.NewFunction(stringGsub(strlib.RawGetString("gsub"))))
+	}
+	if tablib, ok := L.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		tablib.RawSetString("concat", L.NewFunction(tableConcat))
+	}
+}
+
+// meterOf returns the memory meter of the execution running in L, or nil.
+func meterOf(L *lua.LState) *memoryMeter {
+	if budget := budgetOf(L); budget != nil {
+		return budget.meter
+	}
+	return nil
+}
+
+// guardBuiltin wraps builtin so that size, computed from the arguments, is
+// reserved before it runs.
+func guardBuiltin(builtin lua.LValue, size func(L *lua.LState) int64) lua.LGFunction {
+	return func(L *lua.LState) int {
+		meterOf(L).reserve(L, size(L))
+
+		top := L.GetTop()
+		L.Insert(builtin, 1)
+		L.Call(top, lua.MultRet)
+		return L.GetTop()
+	}
+}
+
+func stringRep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if len(str) > 0 && n > math.MaxInt/len(str) {
+		// Too long to represent at all, let alone fit under any limit.
+		meterOf(L).refuse(L)
+	}
+	meterOf(L).reserve(L, int64(len(str))*int64(n))
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// formatSize bounds what string.format can produce: every verb is at most
+// its width and precision plus its argument, escaped or hex-encoded.
+func formatSize(L *lua.LState) int64 {
+	format := L.CheckString(1)
+	size := int64(len(format))
+	arg := 2
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+
+		var numbers [2]int64
+		field := 0
+		for ; i < len(format); i++ {
+			c := format[i]
+			switch {
+			case c >= '0' && c <= '9':
+				numbers[field] = min(numbers[field]*10+int64(c-'0'), 1<<30)
+			case c == '.':
+				field = 1
+			case strings.IndexByte("-+ #", c) >= 0:
+			default:
+				goto verb
+			}
+		}
+	verb:
+		size += numbers[0] + numbers[1] + 32
+
+		if str, ok := L.Get(arg).(lua.LString); ok {
+			factor := int64(1)
+			if i < len(format) {
+				switch format[i] {
+				case 'q':
+					factor = 4
+				case 'x', 'X':
+					factor = 3
+				}
+			}
+			size += factor * int64(len(str))
+		}
+		arg++
+	}
+
+	return size
+}
+
+// stringGsub reserves the result of string.gsub up front when the
+// replacement is a string, and as each replacement is produced when it is
+// a table or function.
+func stringGsub(builtin lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		m := meterOf(L)
+		str := L.CheckString(1)
+		pattern := L.CheckString(2)
+		limit := L.OptInt(4, -1)
+
+		switch repl := L.Get(3).(type) {
+		case lua.LString:
+			matches, err := pm.Find(pattern, []byte(str), 0, limit)
+			if err == nil {
+				m.reserve(L, gsubSize(str, string(repl), matches))
+			}
+		case *lua.LTable, *lua.LFunction:
+			// The result is built in Go memory, out of sight of the
+			// samples, so each replacement is checked against everything
+			// built so far.
+			built := int64(len(str))
+			m.require(L, built)
+			L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+				var value lua.LValue
+				if table, ok := repl.(*lua.LTable); ok {
+					value = L.GetTable(table, L.Get(1))
+				} else {
+					L.Insert(repl, 1)
+					L.Call(L.GetTop()-1, 1)
+					value = L.Get(-1)
+				}
+				if lua.LVCanConvToString(value) {
+					built += int64(len(lua.LVAsString(value)))
+					m.require(L, built)
+				}
+				L.Push(value)
+				return 1
+			}))
+		}
+
+		top := L.GetTop()
+		L.Insert(builtin, 1)
+		L.Call(top, lua.MultRet)
+		return L.GetTop()
+	}
+}
+
+// gsubSize bounds the result of replacing matches in str with repl. A
+// capture lies within its match, or is a position, so each %n in repl
+// expands to at most the match or a number.
+func gsubSize(str string, repl string, matches []*pm.MatchData) int64 {
+	captures := int64(0)
+	for i := 0; i+1 < len(repl); i++ {
+		if repl[i] == '%' {
+			i++
+			if repl[i] >= '0' && repl[i] <= '9' {
+				captures++
+			}
+		}
+	}
+
+	size := int64(len(str))
+	for _, match := range matches {
+		span := int64(match.Capture(1) - match.Capture(0))
+		size += int64(len(repl)) + captures*(span+20)
+	}
+	return size
+}
+
+// tableConcat is table.concat building the result directly instead of on
+// the Lua stack, so its size can be reserved first and a long table cannot
+// overflow the stack.
+func tableConcat(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	i := L.OptInt(3, 1)
+	j := L.OptInt(4, tbl.Len())
+	if L.GetTop() == 3 && (i > tbl.Len() || i < 1) {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	i = max(min(i, tbl.Len()), 1)
+	j = min(j, tbl.Len())
+	if i > j {
+		L.Push(lua.LString(""))
+		return 1
+	}
+
+	parts := make([]string, 0, j-i+1)
+	size := int64(len(sep)) * int64(j-i)
+	for k := i; k <= j; k++ {
+		value := tbl.RawGetInt(k)
+		if !lua.LVCanConvToString(value) {
+			L.RaiseError("invalid value (%s) at index %d in table for concat", value.Type().String(), k)
+		}
+		part := lua.LVAsString(value)
+		parts = append(parts, part)
+		size += int64(len(part))
+	}
+
+	meterOf(L).reserve(L, size)
+	L.Push(lua.LString(strings.Join(parts, sep)))
+	return 1
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.size
+			s = strings.TrimSuffix(s, unit.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size: %w", err)
+	}
+
+	return n * multiplier, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// runTestScript runs script under profile with the default limits, changed
+// by adjust if it is not nil.
+func runTestScript(t *testing.T, profile *SandboxProfile, script string, adjust func(*ExecutionLimits)) (*ExecResult, *ExecutionError) {
+	t.Helper()
+
+	limits := NewLimitsRegistry().ForRole("")
+	if adjust != nil {
+		adjust(&limits)
+	}
+
+	result, err := executeLuaScript(context.Background(), script, ExecOptions{Profile: profile, Limits: limits})
+	if err == nil {
+		return result, nil
+	}
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("error is not an ExecutionError: %v", err)
+	}
+	return result, execErr
+}
+
+func TestMemoryGuardsTripLimit(t *testing.T) {
+	profile := NewSandboxRegistry().DefaultProfile()
+	limitMemory := func(limits *ExecutionLimits) {
+		limits.MaxMemory = 1 << 20
+	}
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"string.rep", `return #string.rep("x", 4 * 1024 * 1024)`},
+		{"string.rep overflow", `local s = string.rep("x", 1024) return #string.rep(s, 2^53)`},
+		{"string.format", `local s = string.rep("x", 300000) return #string.format("%s%s%s%s", s, s, s, s)`},
+		{"string.format width", `return #string.format("%4000000s", "x")`},
+		{"string.gsub string", `local s = string.rep("x", 1000) return #s:gsub("x", string.rep("y", 2000))`},
+		{"string.gsub function", `local r = string.rep("y", 2000) return #string.rep("x", 1000):gsub("x", function() return r end)`},
+		{"string.gsub table", `local r = {x = string.rep("y", 2000)} return #string.rep("x", 1000):gsub("x", r)`},
+		{"table.concat", `local t, s = {}, string.rep("x", 1000) for i = 1, 1100 do t[i] = s end return #table.concat(t)`},
+		{"concatenation", `local s = "x" for i = 1, 30 do s = s .. s end return #s`},
+		{"table of short strings", `local t = {} for i = 1, 1e6 do t[i] = "item" .. i end return #t`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, execErr := runTestScript(t, profile, test.script, limitMemory)
+			if execErr == nil || execErr.Kind != ErrCodeMemoryExceeded {
+				t.Fatalf("got %v, want %s", execErr, ErrCodeMemoryExceeded)
+			}
+		})
+	}
+}
+
+func TestMemoryGuardsAllowSmallResults(t *testing.T) {
+	profile := NewSandboxRegistry().DefaultProfile()
+
+	result, execErr := runTestScript(t, profile, `
+		local s = string.rep("x", 1000)
+		local t = {}
+		for i = 1, 10 do t[i] = s end
+		return #string.format("%s%s", s, s), #s:gsub("x", "yy"), #table.concat(t, ",")
+	`, func(limits *ExecutionLimits) {
+		limits.MaxMemory = 1 << 20
+	})
+	if execErr != nil {
+		t.Fatalf("script failed: %v", execErr)
+	}
+
+	want := []interface{}{2000.0, 2000.0, 10009.0}
+	if len(result.Results) != len(want) {
+		t.Fatalf("results = %v, want %v", result.Results, want)
+	}
+	for i := range want {
+		if result.Results[i] != want[i] {
+			t.Errorf("result %d = %v, want %v", i+1, result.Results[i], want[i])
+		}
+	}
+}
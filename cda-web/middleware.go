@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policy says who may call a route. Public routes still see the caller when
+// a valid token is sent, so they can show signed-in users more.
+type Policy struct {
+	public bool
+	roles  []string
+}
+
+var (
+	Public        = Policy{public: true}
+	Authenticated = Policy{}
+)
+
+// RequireRole admits signed-in users whose role is one of roles.
+func RequireRole(roles ...string) Policy {
+	return Policy{roles: roles}
+}
+
+// Route is one entry of the table main registers through Middleware.
+type Route struct {
+	Pattern string
+	Policy  Policy
+	Handler http.HandlerFunc
+}
+
+type authContextKey struct{}
+
+type authInfo struct {
+	user    *User
+	session *Session
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header. A bare token without the scheme is accepted too, as older clients
+// send it that way. Browsers cannot set headers on a WebSocket, so an
+// upgrade request may pass the token as a "token" query parameter instead.
+func bearerToken(r *http.Request) string {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" && websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	scheme, token, found := strings.Cut(header, " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return header
+}
+
+// Middleware authenticates the request's bearer token and enforces policy
+// before calling next. The caller is available to next via requestUser and
+// requestSession.
+func (am *AuthManager) Middleware(policy Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+
+		var info authInfo
+		if token != "" {
+			info.session = am.session(token)
+			if info.session != nil {
+				info.user = am.GetUser(info.session.UserID)
+			}
+		}
+
+		if !policy.public {
+			if token == "" {
+				unauthorized(w, "Unauthorized")
+				return
+			}
+			if info.user == nil {
+				unauthorized(w, "Invalid token")
+				return
+			}
+			if len(policy.roles) > 0 && !slices.Contains(policy.roles, info.user.Role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		if info.user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, info))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="canda"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// requestUser returns the authenticated caller, or nil on a public route
+// called without a valid token.
+func requestUser(r *http.Request) *User {
+	info, _ := r.Context().Value(authContextKey{}).(authInfo)
+	return info.user
+}
+
+// requestSession returns the session the caller authenticated with.
+func requestSession(r *http.Request) *Session {
+	info, _ := r.Context().Value(authContextKey{}).(authInfo)
+	return info.session
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewarePolicies(t *testing.T) {
+	tokens := setupTestServer(t)
+
+	callers := []struct {
+		name  string
+		token string
+	}{
+		{"anonymous", ""},
+		{"bad token", "nonsense"},
+		{"viewer", tokens["victor"]},
+		{"operator", tokens["alice"]},
+		{"admin", tokens["admin"]},
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   []int // per caller, in the order above
+	}{
+		{"Public", Public, []int{200, 200, 200, 200, 200}},
+		{"Authenticated", Authenticated, []int{401, 401, 200, 200, 200}},
+		{"Viewers", Viewers, []int{401, 401, 200, 200, 200}},
+		{"Operators", Operators, []int{401, 401, 403, 200, 200}},
+		{"Admins", Admins, []int{401, 401, 403, 403, 200}},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, test := range tests {
+		handler := authManager.Middleware(test.policy, ok)
+		for i, caller := range callers {
+			t.Run(test.name+"/"+caller.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				if caller.token != "" {
+					r.Header.Set("Authorization", "Bearer "+caller.token)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != test.want[i] {
+					t.Errorf("status %d, want %d", w.Code, test.want[i])
+				}
+				if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("401 without a WWW-Authenticate header")
+				}
+			})
+		}
+	}
+}
+
+func TestMiddlewareSetsRequestUser(t *testing.T) {
+	tokens := setupTestServer(t)
+
+	var got *User
+	handler := authManager.Middleware(Public, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestUser(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens["alice"])
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.Username != "alice" {
+		t.Fatalf("requestUser = %v, want alice", got)
+	}
+
+	got = &User{}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got != nil {
+		t.Fatalf("requestUser = %v for an anonymous caller, want nil", got)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		url       string
+		websocket bool
+		want      string
+	}{
+		{"bearer", "Bearer abc", "/", false, "abc"},
+		{"scheme is case-insensitive", "bearer abc", "/", false, "abc"},
+		{"extra spaces", "  Bearer   abc  ", "/", false, "abc"},
+		{"bare token", "abc", "/", false, "abc"},
+		{"none", "", "/", false, ""},
+		{"query ignored outside websocket", "", "/execute?token=abc", false, ""},
+		{"query on websocket", "", "/ws?token=abc", true, "abc"},
+		{"header wins on websocket", "Bearer abc", "/ws?token=xyz", true, "abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.websocket {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+
+			if got := bearerToken(r); got != test.want {
+				t.Errorf("bearerToken = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPortStatusHidesHWIDFromAnonymousCallers(t *testing.T) {
+	tokens := setupTestServer(t)
+	handler := authManager.Middleware(Public, http.HandlerFunc(getPortStatus))
+
+	tests := []struct {
+		name     string
+		token    string
+		wantHWID bool
+	}{
+		{"anonymous", "", false},
+		{"bad token", "nonsense", false},
+		{"viewer", tokens["victor"], true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/port-status", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+			var status map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := status["hwid"]; ok != test.wantHWID {
+				t.Errorf("hwid present = %v, want %v", ok, test.wantHWID)
+			}
+		})
+	}
+}
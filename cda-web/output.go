@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxOutputBytes = 1 << 20
+
+type OutputLine struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// outputBuffer collects everything a single execution prints. Once the byte
+// cap is reached further lines are dropped and the buffer is marked truncated.
+type outputBuffer struct {
+	lines     []OutputLine
+	bytes     int
+	truncated bool
+	onLine    func(OutputLine)
+	mu        sync.Mutex
+}
+
+func newOutputBuffer(onLine func(OutputLine)) *outputBuffer {
+	return &outputBuffer{
+		lines:  make([]OutputLine, 0),
+		onLine: onLine,
+	}
+}
+
+func (ob *outputBuffer) WriteLine(text string) {
+	ob.mu.Lock()
+	if ob.bytes+len(text) > maxOutputBytes {
+		ob.truncated = true
+		ob.mu.Unlock()
+		return
+	}
+
+	line := OutputLine{
+		Seq:  len(ob.lines) + 1,
+		Time: time.Now(),
+		Text: text,
+	}
+	ob.lines = append(ob.lines, line)
+	ob.bytes += len(text)
+	ob.mu.Unlock()
+
+	if ob.onLine != nil {
+		ob.onLine(line)
+	}
+}
+
+func (ob *outputBuffer) Lines() []OutputLine {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	lines := make([]OutputLine, len(ob.lines))
+	copy(lines, ob.lines)
+	return lines
+}
+
+func (ob *outputBuffer) Truncated() bool {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return ob.truncated
+}
+
+func (ob *outputBuffer) String() string {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	texts := make([]string, 0, len(ob.lines))
+	for _, line := range ob.lines {
+		texts = append(texts, line.Text)
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hashes are stored as
+//
+//	$argon2id$m=<memory KiB>,t=<passes>,p=<threads>$<salt>$<key>
+//
+// with salt and key in unpadded base64, so the parameters travel with each
+// hash and can be raised without invalidating existing ones. Bare hex
+// SHA-256 digests from before salting still verify and are replaced on the
+// next successful login.
+const (
+	passwordScheme        = "argon2id"
+	defaultPasswordMemory = 19 * 1024
+	defaultPasswordPasses = 2
+	minPasswordMemory     = 8 * 1024
+	maxPasswordMemory     = 1024 * 1024
+	maxPasswordPasses     = 64
+	passwordThreads       = 1
+	passwordSaltSize      = 16
+	passwordKeySize       = 32
+	maxPasswordKeySize    = 64
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// passwordParams is the argon2id cost of a hash. Memory is in KiB.
+type passwordParams struct {
+	Memory  uint32
+	Passes  uint32
+	Threads uint8
+}
+
+func hashPassword(password string, params passwordParams) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Passes, params.Memory, params.Threads, passwordKeySize)
+
+	return fmt.Sprintf("$%s$m=%d,t=%d,p=%d$%s$%s", passwordScheme, params.Memory, params.Passes, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches encoded, comparing in
+// constant time.
+func verifyPassword(password string, encoded string) (bool, error) {
+	if isLegacyHash(encoded) {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(encoded)) == 1, nil
+	}
+
+	params, salt, key, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, params.Passes, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// passwordNeedsRehash reports whether encoded is weaker than what
+// hashPassword would produce now, including any hash in an older form.
+func passwordNeedsRehash(encoded string, params passwordParams) bool {
+	current, _, _, err := parsePasswordHash(encoded)
+	return err != nil || current.Memory < params.Memory || current.Passes < params.Passes
+}
+
+func isLegacyHash(encoded string) bool {
+	if len(encoded) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// parsePasswordHash splits an argon2id hash. Its parameters are bounded so a
+// tampered store cannot make one login take unbounded memory or time.
+func parsePasswordHash(encoded string) (passwordParams, []byte, []byte, error) {
+	var params passwordParams
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != passwordScheme {
+		return params, nil, nil, errMalformedHash
+	}
+
+	var threads uint32
+	_, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &params.Memory, &params.Passes, &threads)
+	if err != nil || parts[2] != fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Passes, threads) ||
+		params.Memory < minPasswordMemory || params.Memory > maxPasswordMemory ||
+		params.Passes < 1 || params.Passes > maxPasswordPasses || threads < 1 || threads > 255 {
+		return params, nil, nil, errMalformedHash
+	}
+	params.Threads = uint8(threads)
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return params, nil, nil, errMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 || len(key) > maxPasswordKeySize {
+		return params, nil, nil, errMalformedHash
+	}
+
+	return params, salt, key, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"strconv"
 	"sync"
@@ -10,62 +11,83 @@ import (
 
 type PortStatus string
 
+// The HTTP listener moves from binding to listening, or to failed if no
+// candidate port can be bound. Degraded means the HTTP API is up but another
+// listener (the TCP console or a Unix socket) is not; stopped follows a clean
+// shutdown.
 const (
-	PortStatusConnecting PortStatus = "connecting"
-	PortStatusConnected  PortStatus = "connected"
-	PortStatusFailed     PortStatus = "failed"
+	PortStatusBinding   PortStatus = "binding"
+	PortStatusListening PortStatus = "listening"
+	PortStatusDegraded  PortStatus = "degraded"
+	PortStatusStopped   PortStatus = "stopped"
+	PortStatusFailed    PortStatus = "failed"
 )
 
+// PortStatusEvent is sent to WebSocket subscribers on every status change and
+// doubles as the status part of /port-status.
+type PortStatusEvent struct {
+	Type      string     `json:"type"`
+	Status    PortStatus `json:"status"`
+	Port      string     `json:"port"`
+	LastError string     `json:"lastError,omitempty"`
+	ChangedAt time.Time  `json:"changedAt"`
+}
+
 type PortManager struct {
+	bindAddr       string
 	availablePorts []int
 	currentPort    string
 	status         PortStatus
+	lastError      string
+	changedAt      time.Time
 	mu             sync.RWMutex
 }
 
-func NewPortManager(ports []int) *PortManager {
+func NewPortManager(cfg *Config) *PortManager {
 	return &PortManager{
-		availablePorts: ports,
-		status:         PortStatusConnecting,
+		bindAddr:       cfg.Listen.BindAddr,
+		availablePorts: cfg.HTTP.Ports,
+		status:         PortStatusBinding,
+		changedAt:      time.Now(),
 	}
 }
 
-func (pm *PortManager) FindAvailablePort() (string, error) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// Listen binds the first free candidate port and returns the live listener,
+// so nothing can take the port before the server starts using it. Port 0
+// asks the OS for any free port; the port actually bound is reported by
+// GetCurrentPort.
+func (pm *PortManager) Listen() (net.Listener, error) {
+	pm.SetStatus(PortStatusBinding, nil)
 
+	var lastErr error
 	for _, port := range pm.availablePorts {
-		portStr := strconv.Itoa(port)
-		
-		fmt.Printf("Trying to connect to port %s\n", portStr)
-		
-		if pm.isPortAvailable(port) {
-			pm.currentPort = portStr
-			pm.status = PortStatusConnected
-			
-			fmt.Printf("Successfully connected to port %s\n", portStr)
-			
-			return portStr, nil
+		address := net.JoinHostPort(pm.bindAddr, strconv.Itoa(port))
+
+		fmt.Printf("Trying to connect to port %d\n", port)
+
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			fmt.Printf("Port %d is unavailable: %v\n", port, err)
+			lastErr = err
+			continue
 		}
-	}
 
-	pm.status = PortStatusFailed
-	return "", fmt.Errorf("no available ports found")
-}
+		pm.mu.Lock()
+		pm.currentPort = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		pm.mu.Unlock()
 
-func (pm *PortManager) isPortAvailable(port int) bool {
-	address := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", address)
-	
-	if err != nil {
-		return false
+		fmt.Printf("Successfully connected to port %s\n", pm.GetCurrentPort())
+
+		pm.SetStatus(PortStatusListening, nil)
+		return listener, nil
+	}
+
+	err := fmt.Errorf("no available ports found")
+	if lastErr != nil {
+		err = fmt.Errorf("no available ports found: %w", lastErr)
 	}
-	
-	listener.Close()
-	
-	time.Sleep(100 * time.Millisecond)
-	
-	return true
+	pm.SetStatus(PortStatusFailed, err)
+	return nil, err
 }
 
 func (pm *PortManager) GetCurrentPort() string {
@@ -80,8 +102,49 @@ func (pm *PortManager) GetStatus() string {
 	return string(pm.status)
 }
 
-func (pm *PortManager) SetStatus(status PortStatus) {
+// Snapshot returns the current status as it is reported to clients.
+func (pm *PortManager) Snapshot() PortStatusEvent {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return PortStatusEvent{
+		Type:      "port-status",
+		Status:    pm.status,
+		Port:      pm.currentPort,
+		LastError: pm.lastError,
+		ChangedAt: pm.changedAt,
+	}
+}
+
+// SetStatus records a transition. A non-nil err becomes the last error; it is
+// kept across later transitions so a recovered listener still shows what went
+// wrong. Degraded never overrides failed or stopped.
+func (pm *PortManager) SetStatus(status PortStatus, err error) {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	if status == PortStatusDegraded && (pm.status == PortStatusFailed || pm.status == PortStatusStopped) {
+		status = pm.status
+	}
+	changed := status != pm.status || err != nil
 	pm.status = status
+	if err != nil {
+		pm.lastError = err.Error()
+	}
+	if changed {
+		pm.changedAt = time.Now()
+	}
+	pm.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if err != nil {
+		log.Printf("Listener status: %s (%v)", status, err)
+	} else {
+		log.Printf("Listener status: %s", status)
+	}
+
+	if wsManager != nil {
+		wsManager.BroadcastJSON(pm.Snapshot())
+	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Roles, from most to least privileged. Admins manage accounts, operators
+// run scripts and viewers may only watch the console.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// Registration modes for AuthConfig.Registration.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var (
+	Viewers   = RequireRole(RoleAdmin, RoleOperator, RoleViewer)
+	Operators = RequireRole(RoleAdmin, RoleOperator)
+	Admins    = RequireRole(RoleAdmin)
+)
+
+func validRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleOperator, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// CanExecute reports whether u may run scripts.
+func (u *User) CanExecute() bool {
+	return u.Role == RoleAdmin || u.Role == RoleOperator
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+type UserListResponse struct {
+	Success bool    `json:"success"`
+	Message string  `json:"message"`
+	Users   []*User `json:"users,omitempty"`
+}
+
+// EnsureAdmin runs at startup. It makes username an admin, creating the
+// account with password if there is none, or with an empty username only
+// warns if the server has no admin at all.
+func (am *AuthManager) EnsureAdmin(username string, password string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if username == "" {
+		users, err := am.store.ListUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if user.Role == RoleAdmin {
+				return nil
+			}
+		}
+		log.Printf("There is no admin account; set CANDA_ADMIN_USER and CANDA_ADMIN_PASSWORD to create one")
+		return nil
+	}
+
+	user, err := am.store.GetUser(username)
+	if errors.Is(err, ErrNotFound) {
+		hash, err := hashPassword(password, am.passwordParams)
+		if err != nil {
+			return err
+		}
+		if err := am.store.PutUser(&User{
+			Username:     username,
+			PasswordHash: hash,
+			Role:         RoleAdmin,
+			CreatedAt:    time.Now(),
+		}); err != nil {
+			return err
+		}
+		log.Printf("Created admin account %s", username)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Role != RoleAdmin {
+		if _, err := am.store.UpdateUser(username, func(stored *User) {
+			stored.Role = RoleAdmin
+		}); err != nil {
+			return err
+		}
+		log.Printf("Made %s an admin", user.Username)
+	}
+	return nil
+}
+
+// HandleListUsers serves GET /admin/users.
+func (am *AuthManager) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := am.store.ListUsers()
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return userKey(users[i].Username) < userKey(users[j].Username)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserListResponse{
+		Success: true,
+		Message: "Users retrieved successfully",
+		Users:   users,
+	})
+}
+
+// HandleSetRole serves POST /admin/users/{username}/role. The last admin
+// cannot be demoted, so the server always has someone who can manage it.
+func (am *AuthManager) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validRole(req.Role) {
+		http.Error(w, "Unknown role: "+req.Role, http.StatusBadRequest)
+		return
+	}
+
+	// Held like a registration, so two demotions cannot both pass the
+	// last-admin check.
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, err := am.store.GetUser(r.PathValue("username"))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Role == RoleAdmin && req.Role != RoleAdmin {
+		users, err := am.store.ListUsers()
+		if err != nil {
+			log.Printf("Failed to list users: %v", err)
+			http.Error(w, "Failed to change role", http.StatusInternalServerError)
+			return
+		}
+
+		admins := 0
+		for _, other := range users {
+			if other.Role == RoleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			http.Error(w, "Cannot demote the last admin", http.StatusConflict)
+			return
+		}
+	}
+
+	previous := user.Role
+	user, err = am.store.UpdateUser(user.Username, func(stored *User) {
+		stored.Role = req.Role
+	})
+	if err != nil {
+		log.Printf("Failed to save role for %s: %v", r.PathValue("username"), err)
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s changed the role of %s from %s to %s", requestUser(r).Username, user.Username, previous, user.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Role updated",
+		User:    user,
+	})
+}
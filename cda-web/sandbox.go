@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	SandboxProfileStrict  = "strict"
+	SandboxProfileTrusted = "trusted"
+)
+
+type sandboxLib struct {
+	name string
+	open lua.LGFunction
+}
+
+// SandboxProfile describes which gopher-lua libraries a script may use and
+// which globals are stripped after they are opened. Level orders profiles by
+// how much they allow so a request can never pick one above what its user was
+// granted.
+type SandboxProfile struct {
+	Name          string
+	Level         int
+	libs          []sandboxLib
+	removeGlobals []string
+	blocked       map[string]bool
+}
+
+var sandboxLibNames = []string{
+	lua.LoadLibName, lua.IoLibName, lua.OsLibName, lua.DebugLibName,
+	lua.ChannelLibName, lua.CoroutineLibName,
+}
+
+type SandboxRegistry struct {
+	profiles       map[string]*SandboxProfile
+	defaultProfile string
+	userProfiles   map[string]string
+	mu             sync.RWMutex
+}
+
+func NewSandboxRegistry() *SandboxRegistry {
+	sr := &SandboxRegistry{
+		profiles:       make(map[string]*SandboxProfile),
+		defaultProfile: SandboxProfileStrict,
+		userProfiles:   make(map[string]string),
+	}
+
+	sr.profiles[SandboxProfileStrict] = &SandboxProfile{
+		Name:  SandboxProfileStrict,
+		Level: 0,
+		libs: []sandboxLib{
+			{lua.BaseLibName, lua.OpenBase},
+			{lua.TabLibName, lua.OpenTable},
+			{lua.StringLibName, lua.OpenString},
+			{lua.MathLibName, lua.OpenMath},
+		},
+		removeGlobals: []string{"dofile", "loadfile", "require", "module", "_printregs"},
+	}
+
+	sr.profiles[SandboxProfileTrusted] = &SandboxProfile{
+		Name:  SandboxProfileTrusted,
+		Level: 1,
+		libs: []sandboxLib{
+			{lua.LoadLibName, lua.OpenPackage},
+			{lua.BaseLibName, lua.OpenBase},
+			{lua.TabLibName, lua.OpenTable},
+			{lua.IoLibName, lua.OpenIo},
+			{lua.OsLibName, lua.OpenOs},
+			{lua.StringLibName, lua.OpenString},
+			{lua.MathLibName, lua.OpenMath},
+			{lua.DebugLibName, lua.OpenDebug},
+			{lua.ChannelLibName, lua.OpenChannel},
+			{lua.CoroutineLibName, lua.OpenCoroutine},
+		},
+	}
+
+	for _, profile := range sr.profiles {
+		profile.computeBlocked()
+	}
+
+	return sr
+}
+
+// computeBlocked records every global the profile hides, either because it
+// was stripped or because its library was never opened.
+func (p *SandboxProfile) computeBlocked() {
+	p.blocked = make(map[string]bool)
+	for _, name := range p.removeGlobals {
+		p.blocked[name] = true
+	}
+
+	opened := make(map[string]bool)
+	for _, lib := range p.libs {
+		opened[lib.name] = true
+	}
+	for _, name := range sandboxLibNames {
+		if !opened[name] {
+			p.blocked[name] = true
+		}
+	}
+}
+
+// blockedUse turns execErr into a sandbox violation if it is the nil index
+// or call that follows reading a hidden global on the same line, as in
+// "io.write()". Hidden globals read as nil, so feature checks like
+// "if io then" still work; only using one is reported.
+func (p *SandboxProfile) blockedUse(budget *budgetContext, execErr *ExecutionError) {
+	if budget.blocked == "" || execErr.Kind != ErrCodeRuntime {
+		return
+	}
+	if budget.blockedAt != fmt.Sprintf("%s:%d:", execErr.Chunk, execErr.Line) {
+		return
+	}
+	if !strings.HasPrefix(execErr.Message, "attempt to index a non-table object(nil)") &&
+		!strings.HasPrefix(execErr.Message, "attempt to call a non-function object") {
+		return
+	}
+
+	execErr.Kind = ErrCodeSandboxViolation
+	execErr.Message = fmt.Sprintf("'%s' is not available in the %s profile", budget.blocked, p.Name)
+}
+
+// Configure sets the default profile and the per-user overrides.
+func (sr *SandboxRegistry) Configure(cfg SandboxConfig) error {
+	if cfg.DefaultProfile != "" {
+		if err := sr.SetDefaultProfile(cfg.DefaultProfile); err != nil {
+			return fmt.Errorf("sandbox.defaultProfile: %w", err)
+		}
+	}
+
+	for username, profile := range cfg.Users {
+		if err := sr.SetUserProfile(username, profile); err != nil {
+			return fmt.Errorf("sandbox.users.%s: %w", username, err)
+		}
+	}
+
+	return nil
+}
+
+func (sr *SandboxRegistry) GetProfile(name string) (*SandboxProfile, error) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	profile, exists := sr.profiles[strings.ToLower(strings.TrimSpace(name))]
+	if !exists {
+		return nil, fmt.Errorf("unknown sandbox profile: %s", name)
+	}
+
+	return profile, nil
+}
+
+func (sr *SandboxRegistry) DefaultProfile() *SandboxProfile {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.profiles[sr.defaultProfile]
+}
+
+func (sr *SandboxRegistry) SetDefaultProfile(name string) error {
+	profile, err := sr.GetProfile(name)
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.defaultProfile = profile.Name
+	return nil
+}
+
+func (sr *SandboxRegistry) SetUserProfile(username string, name string) error {
+	profile, err := sr.GetProfile(name)
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.userProfiles[strings.ToLower(strings.TrimSpace(username))] = profile.Name
+	return nil
+}
+
+// Resolve picks the profile for a single execution. A user without an
+// override gets the default profile; a requested profile is honoured only if
+// it does not grant more than the user's assigned one.
+func (sr *SandboxRegistry) Resolve(user *User, requested string) (*SandboxProfile, error) {
+	assigned := sr.DefaultProfile()
+
+	if user != nil {
+		sr.mu.RLock()
+		name, exists := sr.userProfiles[strings.ToLower(user.Username)]
+		sr.mu.RUnlock()
+
+		if exists {
+			profile, err := sr.GetProfile(name)
+			if err != nil {
+				return nil, err
+			}
+			assigned = profile
+		}
+	}
+
+	if requested == "" {
+		return assigned, nil
+	}
+
+	profile, err := sr.GetProfile(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.Level > assigned.Level {
+		return nil, fmt.Errorf("sandbox profile %s is not permitted", profile.Name)
+	}
+
+	return profile, nil
+}
+
+// NewState creates a Lua state with only the profile's libraries opened and
+// its stacks sized from the execution limits.
+func (p *SandboxProfile) NewState(limits ExecutionLimits) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   limits.CallStackSize,
+		RegistrySize:    lua.RegistrySize,
+		RegistryMaxSize: limits.RegistryMaxSize,
+	})
+
+	for _, lib := range p.libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range p.removeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	installMemoryGuards(L)
+
+	if len(p.blocked) > 0 {
+		guard := L.NewTable()
+		guard.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+			if name, ok := L.Get(2).(lua.LString); ok && p.blocked[string(name)] {
+				if budget := budgetOf(L); budget != nil {
+					budget.blocked = string(name)
+					budget.blockedAt = L.Where(1)
+				}
+			}
+			L.Push(lua.LNil)
+			return 1
+		}))
+		guard.RawSetString("__metatable", lua.LString("sandbox"))
+		L.SetMetatable(L.G.Global, guard)
+	}
+
+	return L
+}
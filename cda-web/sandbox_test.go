@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestStrictProfileReportsHiddenGlobals(t *testing.T) {
+	profile := NewSandboxRegistry().DefaultProfile()
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"os", `return os.time()`},
+		{"io", `io.write("x")`},
+		{"require", `return require("socket")`},
+		{"coroutine", `return coroutine.create(function() end)`},
+		{"dofile", `dofile("/etc/passwd")`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, execErr := runTestScript(t, profile, test.script, nil)
+			if execErr == nil || execErr.Kind != ErrCodeSandboxViolation {
+				t.Fatalf("got %v, want %s", execErr, ErrCodeSandboxViolation)
+			}
+		})
+	}
+}
+
+func TestStrictProfileHiddenGlobalsReadAsNil(t *testing.T) {
+	profile := NewSandboxRegistry().DefaultProfile()
+
+	result, execErr := runTestScript(t, profile, `
+		local used = "none"
+		if os then used = os.time() end
+		if io then io.write("x") end
+		return used, type(os), require == nil
+	`, nil)
+	if execErr != nil {
+		t.Fatalf("script failed: %v", execErr)
+	}
+
+	want := []interface{}{"none", "nil", true}
+	for i := range want {
+		if i >= len(result.Results) || result.Results[i] != want[i] {
+			t.Fatalf("results = %v, want %v", result.Results, want)
+		}
+	}
+}
+
+func TestUnrelatedNilErrorsStayRuntime(t *testing.T) {
+	profile := NewSandboxRegistry().DefaultProfile()
+
+	_, execErr := runTestScript(t, profile, "local f = io\nreturn f.open", nil)
+	if execErr == nil || execErr.Kind != ErrCodeRuntime {
+		t.Fatalf("got %v, want %s", execErr, ErrCodeRuntime)
+	}
+}
+
+func TestTrustedProfileOpensEverything(t *testing.T) {
+	profile, err := NewSandboxRegistry().GetProfile(SandboxProfileTrusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, execErr := runTestScript(t, profile, `return type(os), type(io), type(require), type(coroutine)`, nil)
+	if execErr != nil {
+		t.Fatalf("script failed: %v", execErr)
+	}
+	for i, value := range result.Results {
+		if value != "table" && value != "function" {
+			t.Errorf("result %d = %v, want the library to be present", i+1, value)
+		}
+	}
+}
+
+func TestResolveRejectsHigherProfile(t *testing.T) {
+	sr := NewSandboxRegistry()
+	if err := sr.SetUserProfile("alice", SandboxProfileStrict); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.SetUserProfile("root", SandboxProfileTrusted); err != nil {
+		t.Fatal(err)
+	}
+	alice := &User{Username: "Alice", Role: RoleOperator}
+	root := &User{Username: "root", Role: RoleAdmin}
+
+	tests := []struct {
+		name      string
+		user      *User
+		requested string
+		want      string
+	}{
+		{"assigned profile by default", alice, "", SandboxProfileStrict},
+		{"strict user asks for strict", alice, SandboxProfileStrict, SandboxProfileStrict},
+		{"strict user asks for trusted", alice, SandboxProfileTrusted, ""},
+		{"trusted user asks for strict", root, SandboxProfileStrict, SandboxProfileStrict},
+		{"trusted user asks for trusted", root, SandboxProfileTrusted, SandboxProfileTrusted},
+		{"unknown profile", root, "unbounded", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, err := sr.Resolve(test.user, test.requested)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("Resolve gave %s, want an error", profile.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if profile.Name != test.want {
+				t.Errorf("Resolve gave %s, want %s", profile.Name, test.want)
+			}
+		})
+	}
+}
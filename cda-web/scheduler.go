@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+const schedulerRetryAfter = 2
+
+var (
+	ErrSchedulerBusy = errors.New("execution queue is full")
+	ErrShuttingDown  = errors.New("executor is shutting down")
+	ErrTaskPanicked  = errors.New("execution failed with an internal error")
+)
+
+type schedTask struct {
+	owner   string
+	session string
+	run     func()
+	done  chan struct{}
+	err   error
+}
+
+// Scheduler runs script executions on a fixed pool of workers. Pending tasks
+// are kept in one FIFO per owner and workers take from owners in round-robin
+// order, skipping any owner already at its concurrency limit, so one busy
+// user cannot starve the others. Each owner may also hold only queuePerUser
+// of the queue's slots, so one user cannot fill it and lock everyone out.
+// Tasks that name a Lua session run one at a time: a task whose session is
+// already running stays queued, rather than holding a worker while it waits
+// for the session.
+type Scheduler struct {
+	workers      int
+	queueSize    int
+	queuePerUser int
+	perUser      int
+	queues       map[string][]*schedTask
+	order        []string
+	running      map[string]int
+	sessions     map[string]bool
+	queued       int
+	closed       bool
+	mu           sync.Mutex
+	cond         *sync.Cond
+}
+
+func NewScheduler(workers int, queueSize int, queuePerUser int, perUser int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if perUser < 1 {
+		perUser = workers
+	}
+	if queuePerUser < 1 || queuePerUser > queueSize {
+		queuePerUser = queueSize
+	}
+
+	s := &Scheduler{
+		workers:      workers,
+		queueSize:    queueSize,
+		queuePerUser: queuePerUser,
+		perUser:      perUser,
+		queues:       make(map[string][]*schedTask),
+		running:      make(map[string]int),
+		sessions:     make(map[string]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+
+	log.Printf("Execution scheduler started with %d workers, queue size %d (%d per user), %d running per user", workers, queueSize, queuePerUser, perUser)
+
+	return s
+}
+
+// Submit queues fn without waiting for it to run. session is the ID of the
+// Lua session fn executes in, or empty if it uses none.
+func (s *Scheduler) Submit(owner string, session string, fn func()) error {
+	_, err := s.enqueue(owner, session, fn)
+	return err
+}
+
+// Run queues fn and blocks until it has finished. If ctx ends while the task
+// is still queued, it is dropped from the queue and the context error is
+// returned straight away; once fn has started, Run waits for it.
+func (s *Scheduler) Run(ctx context.Context, owner string, session string, fn func()) error {
+	task, err := s.enqueue(owner, session, fn)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-task.done:
+		return task.err
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	removed := s.removeLocked(task)
+	s.mu.Unlock()
+	if removed {
+		return ctx.Err()
+	}
+
+	<-task.done
+	return task.err
+}
+
+func (s *Scheduler) enqueue(owner string, session string, fn func()) (*schedTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrShuttingDown
+	}
+	if s.queued >= s.queueSize || len(s.queues[owner]) >= s.queuePerUser {
+		return nil, ErrSchedulerBusy
+	}
+
+	task := &schedTask{
+		owner:   owner,
+		session: session,
+		run:     fn,
+		done:    make(chan struct{}),
+	}
+
+	if len(s.queues[owner]) == 0 {
+		s.order = append(s.order, owner)
+	}
+	s.queues[owner] = append(s.queues[owner], task)
+	s.queued++
+
+	s.cond.Signal()
+
+	return task, nil
+}
+
+// nextLocked pops the next task in round-robin order, or returns nil if every
+// owner with pending work is at its concurrency limit or waiting on sessions
+// that are already running. Within an owner's queue the oldest task that can
+// run goes first.
+func (s *Scheduler) nextLocked() *schedTask {
+	for i, owner := range s.order {
+		if s.running[owner] >= s.perUser {
+			continue
+		}
+
+		queue := s.queues[owner]
+		j := 0
+		for j < len(queue) && queue[j].session != "" && s.sessions[queue[j].session] {
+			j++
+		}
+		if j == len(queue) {
+			continue
+		}
+		task := queue[j]
+
+		s.order = append(s.order[:i], s.order[i+1:]...)
+		if len(queue) > 1 {
+			s.queues[owner] = append(queue[:j:j], queue[j+1:]...)
+			s.order = append(s.order, owner)
+		} else {
+			delete(s.queues, owner)
+		}
+
+		s.queued--
+		s.running[owner]++
+		if task.session != "" {
+			s.sessions[task.session] = true
+		}
+		return task
+	}
+	return nil
+}
+
+// removeLocked drops a task that has not been picked up yet, reporting
+// whether it was still queued.
+func (s *Scheduler) removeLocked(task *schedTask) bool {
+	queue := s.queues[task.owner]
+	for i, queued := range queue {
+		if queued != task {
+			continue
+		}
+
+		if len(queue) > 1 {
+			s.queues[task.owner] = append(queue[:i:i], queue[i+1:]...)
+		} else {
+			delete(s.queues, task.owner)
+			for j, owner := range s.order {
+				if owner == task.owner {
+					s.order = append(s.order[:j], s.order[j+1:]...)
+					break
+				}
+			}
+		}
+		s.queued--
+		return true
+	}
+	return false
+}
+
+// execute runs one task. A panic fails only that task; the worker carries
+// on with the next one.
+func (s *Scheduler) execute(task *schedTask) {
+	defer close(task.done)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Execution for %s panicked: %v\n%s", task.owner, r, debug.Stack())
+			task.err = ErrTaskPanicked
+		}
+	}()
+
+	task.run()
+}
+
+func (s *Scheduler) worker() {
+	for {
+		s.mu.Lock()
+		task := s.nextLocked()
+		for task == nil {
+			s.cond.Wait()
+			task = s.nextLocked()
+		}
+		s.mu.Unlock()
+
+		s.execute(task)
+
+		s.mu.Lock()
+		s.running[task.owner]--
+		if s.running[task.owner] == 0 {
+			delete(s.running, task.owner)
+		}
+		delete(s.sessions, task.session)
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+// Close stops accepting new tasks. Tasks already queued still run, so
+// callers waiting in Run are not stranded.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func (s *Scheduler) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := 0
+	for _, n := range s.running {
+		running += n
+	}
+
+	return map[string]interface{}{
+		"workers":      s.workers,
+		"queueSize":    s.queueSize,
+		"queuePerUser": s.queuePerUser,
+		"perUser":      s.perUser,
+		"queued":       s.queued,
+		"running":      running,
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockWorkers occupies every worker of s with tasks owned by owner until
+// the returned function is called.
+func blockWorkers(t *testing.T, s *Scheduler, owner string, workers int) func() {
+	t.Helper()
+
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(workers)
+	for i := 0; i < workers; i++ {
+		if err := s.Submit(owner, "", func() {
+			started.Done()
+			<-release
+		}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+	started.Wait()
+
+	return func() { close(release) }
+}
+
+func TestSchedulerQueueLimits(t *testing.T) {
+	s := NewScheduler(1, 4, 2, 1)
+	defer s.Close()
+	release := blockWorkers(t, s, "blocker", 1)
+	defer release()
+
+	tests := []struct {
+		owner string
+		want  error
+	}{
+		{"alice", nil},
+		{"alice", nil},
+		{"alice", ErrSchedulerBusy}, // alice holds her share of the queue
+		{"bob", nil},
+		{"bob", nil},
+		{"carol", ErrSchedulerBusy}, // the queue is full
+	}
+
+	for i, test := range tests {
+		if err := s.Submit(test.owner, "", func() {}); err != test.want {
+			t.Errorf("submission %d by %s: got %v, want %v", i+1, test.owner, err, test.want)
+		}
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := NewScheduler(1, 16, 16, 1)
+	defer s.Close()
+	release := blockWorkers(t, s, "blocker", 1)
+
+	var mu sync.Mutex
+	var order []string
+	var done sync.WaitGroup
+	submit := func(owner string, name string) {
+		done.Add(1)
+		if err := s.Submit(owner, "", func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			done.Done()
+		}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+
+	submit("alice", "a1")
+	submit("alice", "a2")
+	submit("alice", "a3")
+	submit("bob", "b1")
+	submit("bob", "b2")
+	submit("carol", "c1")
+
+	release()
+	done.Wait()
+
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerRunsOneTaskPerSession(t *testing.T) {
+	s := NewScheduler(2, 16, 16, 2)
+	defer s.Close()
+
+	started := make(chan string, 3)
+	run := func(session string, name string) chan struct{} {
+		release := make(chan struct{})
+		go s.Run(context.Background(), "alice", session, func() {
+			started <- name
+			<-release
+		})
+		return release
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-started:
+			if got != want {
+				t.Fatalf("started %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not start", want)
+		}
+	}
+
+	first := run("s1", "first")
+	expect("first")
+
+	// The second task waits for its session without taking the free worker,
+	// which goes to the task that needs no session.
+	second := run("s1", "second")
+	defer close(second)
+	time.Sleep(10 * time.Millisecond)
+	fresh := run("", "fresh")
+	defer close(fresh)
+	expect("fresh")
+
+	close(first)
+	expect("second")
+}
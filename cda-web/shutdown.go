@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// shutdown stops the executor in order: new work is refused, the listeners
+// close, running executions get until ctx ends to finish, and only then are
+// the Lua sessions, WebSocket clients and auth store closed.
+// cancelRequests aborts HTTP requests still running when ctx ends.
+func shutdown(ctx context.Context, servers []*http.Server, cancelRequests context.CancelFunc) {
+	wsManager.BroadcastMessage("[System] Server shutting down")
+	scheduler.Close()
+
+	var wg sync.WaitGroup
+	stop := func(name string, fn func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx); err != nil {
+				log.Printf("Shutting down %s: %v", name, err)
+			}
+		}()
+	}
+
+	for _, server := range servers {
+		stop("HTTP server", func(ctx context.Context) error {
+			err := server.Shutdown(ctx)
+			if err != nil {
+				cancelRequests()
+			}
+			return err
+		})
+	}
+	if tcpConsole != nil {
+		stop("TCP server", tcpConsole.Shutdown)
+	}
+	stop("jobs", jobManager.Shutdown)
+
+	wg.Wait()
+
+	luaSessions.CloseAll()
+	wsManager.Close()
+
+	if err := authManager.Close(); err != nil {
+		log.Printf("Closing auth store: %v", err)
+	}
+}
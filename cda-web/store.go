@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// AuthStore persists accounts and login sessions for AuthManager. Users are
+// keyed by their lower-cased username and sessions by the hash of their
+// token. Lookups of missing records return ErrNotFound. Stores hand out
+// copies, so callers may keep or modify what they get back.
+type AuthStore interface {
+	GetUser(username string) (*User, error)
+	ListUsers() ([]*User, error)
+	PutUser(user *User) error
+	// UpdateUser applies update to the stored user under the store's lock
+	// and returns the result, so concurrent changes to different fields are
+	// not lost. update must not change the username.
+	UpdateUser(username string, update func(*User)) (*User, error)
+	GetSession(tokenHash string) (*Session, error)
+	ListSessions(username string) ([]*Session, error)
+	PutSession(session *Session) error
+	// ExtendSession moves an existing session's expiry, returning
+	// ErrNotFound if it has been revoked or has expired and been removed.
+	ExtendSession(tokenHash string, expiresAt time.Time) error
+	DeleteSession(tokenHash string) error
+	// DeleteExpiredSessions removes sessions that expired before now and
+	// returns how many there were.
+	DeleteExpiredSessions(now time.Time) (int, error)
+	Close() error
+}
+
+func userKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// MemoryStore keeps everything in memory and loses it on exit. It is the
+// store used when no file is configured.
+type MemoryStore struct {
+	users    map[string]*User
+	sessions map[string]*Session
+	mu       sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:    make(map[string]*User),
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *MemoryStore) GetUser(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[userKey(username)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *MemoryStore) ListUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) PutUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *user
+	s.users[userKey(user.Username)] = &copied
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(username string, update func(*User)) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := userKey(username)
+	user, exists := s.users[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	updated := *user
+	update(&updated)
+	s.users[key] = &updated
+
+	copied := updated
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetSession(tokenHash string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (s *MemoryStore) ListSessions(username string) ([]*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := make([]*Session, 0)
+	for _, session := range s.sessions {
+		if session.UserID == userKey(username) {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemoryStore) PutSession(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *session
+	s.sessions[session.TokenHash] = &copied
+	return nil
+}
+
+func (s *MemoryStore) ExtendSession(tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return ErrNotFound
+	}
+	session.ExpiresAt = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) DeleteSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredSessions(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.expireLocked(now)), nil
+}
+
+// expireLocked removes expired sessions and returns them, so a caller that
+// fails to persist the change can put them back.
+func (s *MemoryStore) expireLocked(now time.Time) map[string]*Session {
+	expired := make(map[string]*Session)
+	for tokenHash, session := range s.sessions {
+		if !now.Before(session.ExpiresAt) {
+			expired[tokenHash] = session
+			delete(s.sessions, tokenHash)
+		}
+	}
+	return expired
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	maxTCPLineSize   = 1 << 20
+	tcpIdleTimeout   = 1 * time.Hour
+	tcpShutdownGrace = 1 * time.Second
+	replPrompt       = "> "
+	replContinue     = ">> "
+)
+
+const replHelp = `Commands:
+  :help    show this help
+  :reset   discard all globals and any unfinished chunk, and start a
+           fresh Lua state
+  :quit    close the connection
+Lines are collected until they form a complete chunk. Expressions print
+their values; prefix a line with = to force it to be read as an expression.
+`
+
+// tcpServer tracks the console's listeners and connections so they can be
+// shut down. Executions run under its context, which is cancelled when the
+// shutdown deadline passes.
+type tcpServer struct {
+	listeners []net.Listener
+	clients   map[*tcpClient]bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closing   bool
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+}
+
+// tcpClient holds the per-connection state of the TCP console.
+type tcpClient struct {
+	server  *tcpServer
+	ctx     context.Context
+	conn    net.Conn
+	addr    string
+	scanner *bufio.Scanner
+	session *LuaSession
+	wire    *wireConn
+	user    *User
+	// tokenHash names the login session the client signed in with, if
+	// it used a token, so the session can be checked before each script.
+	tokenHash string
+}
+
+func newTCPServer() *tcpServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tcpServer{
+		clients: make(map[*tcpClient]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (s *tcpServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	client := &tcpClient{
+		server:  s,
+		ctx:     s.ctx,
+		conn:    conn,
+		addr:    connAddr(conn),
+		scanner: bufio.NewScanner(conn),
+	}
+	client.scanner.Buffer(make([]byte, 4096), maxTCPLineSize)
+	defer client.closeSession()
+
+	s.mu.Lock()
+	s.clients[client] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+	}()
+	defer client.goodbye()
+
+	log.Printf("TCP client connected: %s", client.addr)
+	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client connected: %s", client.addr))
+
+	user, err := clientCertUser(conn)
+	if err != nil {
+		log.Printf("TLS handshake with %s failed: %v", client.addr, err)
+		return
+	}
+
+	client.write("Connected to Canda executor TCP server\n")
+	if user != nil {
+		client.user = user
+		log.Printf("TCP client %s authenticated as %s by client certificate", client.addr, user.Username)
+		client.write(fmt.Sprintf("OK: Authenticated as %s\n", user.Username))
+	}
+	client.write("Send AUTH <token> to sign in, then :repl for an interactive Lua console or :help for commands\n")
+	client.write(fmt.Sprintf("Send {\"type\":\"hello\",\"version\":%d,\"token\":\"...\"} to use the framed protocol\n", wireProtocolVersion))
+
+	for {
+		line, ok := client.readLine()
+		if !ok {
+			return
+		}
+
+		data := strings.TrimSpace(line)
+
+		if hello, ok := parseHello(data); ok {
+			client.runWire(hello)
+			return
+		}
+
+		if strings.HasPrefix(data, "AUTH ") {
+			client.auth(strings.TrimSpace(strings.TrimPrefix(data, "AUTH ")))
+			continue
+		}
+
+		log.Printf("Received from %s (%s): %s", client.label(), client.addr, data)
+
+		switch {
+		case data == ":repl":
+			if err := client.reauthorize(); err != nil {
+				client.write(fmt.Sprintf("Error: %v\n", err))
+				return
+			}
+			if client.requireExecute() {
+				client.runRepl()
+				return
+			}
+		case data == ":help":
+			client.write(replHelp)
+		case data == ":quit":
+			client.write("Goodbye\n")
+			return
+		case strings.HasPrefix(data, "CHECK:"):
+			if client.requireAuth() {
+				client.check(strings.TrimPrefix(data, "CHECK:"))
+			}
+		case strings.HasPrefix(data, "EXEC:"):
+			if err := client.reauthorize(); err != nil {
+				client.write(fmt.Sprintf("Error: %v\n", err))
+				return
+			}
+			if client.requireExecute() {
+				client.exec(strings.TrimPrefix(data, "EXEC:"))
+			}
+		default:
+			client.write(fmt.Sprintf("Echo: %s\n", data))
+		}
+	}
+}
+
+// connAddr names the peer for logs and rate limiting. Unix socket peers are
+// anonymous, so they share the socket's path.
+func connAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr().String(); addr != "" && addr != "@" {
+		return addr
+	}
+	return "unix:" + conn.LocalAddr().String()
+}
+
+func (c *tcpClient) write(s string) {
+	c.conn.Write([]byte(s))
+}
+
+// goodbye tells the client the server is going away, if it is.
+func (c *tcpClient) goodbye() {
+	if !c.server.isClosing() {
+		return
+	}
+	if c.wire != nil {
+		c.wire.send(WireResponse{Type: "bye", Message: "server shutting down"})
+	} else {
+		c.write("Server shutting down, goodbye\n")
+	}
+}
+
+// label identifies the client in logs and broadcasts.
+func (c *tcpClient) label() string {
+	if c.user != nil {
+		return "TCP " + c.user.Username
+	}
+	return "TCP"
+}
+
+func (c *tcpClient) auth(credential string) {
+	user, tokenHash, err := tcpAuth.Authenticate(c.addr, credential)
+	if err != nil {
+		log.Printf("TCP authentication failed for %s: %v", c.addr, err)
+		c.write(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+
+	c.user = user
+	c.tokenHash = tokenHash
+	log.Printf("TCP client %s authenticated as %s", c.addr, user.Username)
+	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client %s authenticated as %s", c.addr, user.Username))
+	c.write(fmt.Sprintf("OK: Authenticated as %s\n", user.Username))
+}
+
+func (c *tcpClient) requireAuth() bool {
+	if c.user == nil {
+		c.write("Error: authentication required, send AUTH <token> first\n")
+		return false
+	}
+	return true
+}
+
+// requireExecute is requireAuth for commands that run scripts, which
+// viewers may not.
+func (c *tcpClient) requireExecute() bool {
+	if !c.requireAuth() {
+		return false
+	}
+	if !c.user.CanExecute() {
+		c.write(fmt.Sprintf("Error: role %s may not run scripts\n", c.user.Role))
+		return false
+	}
+	return true
+}
+
+// reauthorize looks the signed-in user up again before a script runs, so a
+// logout, revoked session or demotion takes effect on open connections. It
+// returns the reason the connection must be closed, or nil if it may carry
+// on. Clients that have not signed in, or never could run scripts, are left
+// to requireAuth and requireExecute.
+func (c *tcpClient) reauthorize() error {
+	if c.user == nil {
+		return nil
+	}
+
+	user := tcpAuth.Reauthenticate(c.user, c.tokenHash)
+	if user == nil {
+		log.Printf("TCP client %s: session of %s has ended, closing", c.addr, c.user.Username)
+		return errors.New("session has ended")
+	}
+	if c.user.CanExecute() && !user.CanExecute() {
+		log.Printf("TCP client %s: %s is now %s, closing", c.addr, user.Username, user.Role)
+		return fmt.Errorf("role %s may not run scripts", user.Role)
+	}
+
+	c.user = user
+	return nil
+}
+
+// execOptions returns the profile and limits the signed-in user is entitled to.
+func (c *tcpClient) execOptions() (ExecOptions, error) {
+	profile, err := sandbox.Resolve(c.user, "")
+	if err != nil {
+		return ExecOptions{}, err
+	}
+
+	return ExecOptions{
+		Profile: profile,
+		Limits:  execLimits.ForUser(c.user),
+		Source:  c.label(),
+	}, nil
+}
+
+// readLine returns the next newline-terminated line, or false once the
+// connection is closed or unusable.
+func (c *tcpClient) readLine() (string, bool) {
+	// Checked under the server's lock so a shutdown cannot slip in between
+	// and have its deadline replaced by the idle timeout.
+	c.server.mu.Lock()
+	closing := c.server.closing
+	if !closing {
+		c.conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+	}
+	c.server.mu.Unlock()
+	if closing {
+		return "", false
+	}
+
+	if c.scanner.Scan() {
+		return c.scanner.Text(), true
+	}
+
+	err := c.scanner.Err()
+	switch {
+	case c.server.isClosing():
+		// Shutdown interrupted the read; goodbye is sent on the way out.
+	case err == nil || errors.Is(err, io.EOF):
+		log.Printf("TCP client disconnected: %s", c.addr)
+		wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client disconnected: %s", c.addr))
+	case errors.Is(err, bufio.ErrTooLong):
+		message := fmt.Sprintf("line exceeds %d bytes", maxTCPLineSize)
+		if c.wire != nil {
+			c.wire.sendError("", wireCodeBadRequest, message)
+		} else {
+			c.write("Error: " + message + "\n")
+		}
+		log.Printf("TCP client %s sent an oversized line", c.addr)
+	default:
+		log.Printf("Error reading from TCP client: %v", err)
+		wsManager.BroadcastMessage(fmt.Sprintf("[Error] TCP read error: %v", err))
+	}
+	return "", false
+}
+
+func (c *tcpClient) check(script string) {
+	diagnostics := validateLuaScript(script, defaultChunkName)
+	if len(diagnostics) == 0 {
+		c.write("OK: No syntax errors\n")
+	}
+	for _, diagnostic := range diagnostics {
+		c.write(fmt.Sprintf("Error: %v\n", diagnostic))
+	}
+}
+
+// run schedules one execution for this connection. If it could not run, for
+// instance because the queue is full, the client is told why and the result
+// is nil.
+func (c *tcpClient) run(script string, opts ExecOptions) (*ExecResult, error) {
+	var result *ExecResult
+	var err error
+
+	log.Printf("TCP execution by %s (%s)", c.user.Username, c.addr)
+
+	schedErr := scheduler.Run(c.ctx, c.user.Username, opts.sessionID(), func() {
+		result, err = executeLuaScript(c.ctx, script, opts)
+	})
+	switch {
+	case schedErr == ErrSchedulerBusy:
+		c.write(fmt.Sprintf("BUSY: %v, retry in %ds\n", schedErr, schedulerRetryAfter))
+		return nil, schedErr
+	case schedErr != nil:
+		c.write(fmt.Sprintf("Error: %v\n", schedErr))
+		return nil, schedErr
+	}
+
+	return result, err
+}
+
+func (c *tcpClient) exec(script string) {
+	opts, err := c.execOptions()
+	if err != nil {
+		c.write(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+
+	result, err := c.run(script, opts)
+	if result == nil {
+		return
+	}
+
+	for _, line := range result.Lines {
+		c.write(line.Text + "\n")
+	}
+
+	if err != nil {
+		c.write(fmt.Sprintf("Error: %v\n", err))
+	} else if len(result.Results) > 0 {
+		encoded, _ := json.Marshal(result.Results)
+		c.write(fmt.Sprintf("Success: %s\n", encoded))
+	} else {
+		c.write("Success: Script executed successfully\n")
+	}
+}
+
+func (c *tcpClient) closeSession() {
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+}
+
+// runRepl reads chunks line by line until the client quits, keeping one Lua
+// state for the life of the connection.
+func (c *tcpClient) runRepl() {
+	opts, err := c.execOptions()
+	if err != nil {
+		c.write(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+	c.session = newLuaSession(c.user.Username, opts.Profile, opts.Limits)
+
+	c.write(fmt.Sprintf("Lua REPL (%s profile). Type :help for commands.\n", c.session.ProfileName))
+
+	var pending []string
+	for {
+		if len(pending) == 0 {
+			c.write(replPrompt)
+		} else {
+			c.write(replContinue)
+		}
+
+		line, ok := c.readLine()
+		if !ok {
+			return
+		}
+
+		// Commands are honoured inside an unfinished chunk too, so :reset
+		// can abandon one.
+		switch strings.TrimSpace(line) {
+		case "":
+			if len(pending) == 0 {
+				continue
+			}
+		case ":help":
+			c.write(replHelp)
+			continue
+		case ":reset":
+			pending = nil
+			c.session.Reset()
+			c.write("Lua state reset\n")
+			continue
+		case ":quit", ":exit":
+			c.write("Goodbye\n")
+			return
+		}
+
+		pending = append(pending, line)
+		source := strings.Join(pending, "\n")
+		if len(source) > maxTCPLineSize {
+			c.write(fmt.Sprintf("Error: chunk exceeds %d bytes\n", maxTCPLineSize))
+			pending = nil
+			continue
+		}
+
+		chunk, complete := replChunk(source)
+		if !complete {
+			continue
+		}
+		pending = nil
+
+		if err := c.reauthorize(); err != nil {
+			c.write(fmt.Sprintf("Error: %v\n", err))
+			return
+		}
+		c.evalRepl(chunk)
+	}
+}
+
+func (c *tcpClient) evalRepl(chunk string) {
+	result, err := c.run(chunk, ExecOptions{
+		Profile:     c.session.Profile,
+		Limits:      execLimits.ForUser(c.user),
+		Session:     c.session,
+		Source:      c.label(),
+		ChunkName:   "stdin",
+		TextResults: true,
+		OnOutput: func(line OutputLine) {
+			c.write(line.Text + "\n")
+		},
+	})
+	if result == nil {
+		return
+	}
+
+	if err != nil {
+		c.write(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+
+	if len(result.Display) > 0 {
+		c.write(strings.Join(result.Display, "\t") + "\n")
+	}
+}
+
+// replChunk decides how to run what the user has typed so far, the way the
+// standalone lua interpreter does: "=expr" and bare expressions are run as
+// "return expr", and a chunk whose only error is an unexpected end of input
+// is incomplete and waits for more lines. Other syntax errors are returned as
+// complete so running them reports the error.
+func replChunk(source string) (string, bool) {
+	if strings.HasPrefix(source, "=") {
+		source = "return " + source[1:]
+	} else if _, err := parse.Parse(strings.NewReader("return "+source), "stdin"); err == nil {
+		return "return " + source, true
+	}
+
+	_, err := parse.Parse(strings.NewReader(source), "stdin")
+	var parseErr *parse.Error
+	if errors.As(err, &parseErr) && parseErr.Pos.Line == parse.EOF {
+		return source, false
+	}
+
+	return source, true
+}
+
+// startTCPServer listens on the configured address and port, plus the Unix
+// socket if one is configured. TLS only applies to the network listener.
+// Either listener can start without the other; the errors of any that could
+// not are returned together.
+func startTCPServer(cfg *Config, tlsConfig *tls.Config) error {
+	tcpConsole = newTCPServer()
+
+	var errs []error
+	if err := startTCPListener(cfg, tlsConfig); err != nil {
+		log.Printf("Failed to start TCP server: %v", err)
+		errs = append(errs, fmt.Errorf("TCP server: %w", err))
+	}
+
+	if cfg.Listen.TCPSocket != "" {
+		socket, err := listenUnix(cfg.Listen.TCPSocket)
+		if err != nil {
+			log.Printf("Failed to start TCP console socket: %v", err)
+			errs = append(errs, fmt.Errorf("TCP console socket: %w", err))
+		} else {
+			tcpConsole.serve(socket)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func startTCPListener(cfg *Config, tlsConfig *tls.Config) error {
+	addr := net.JoinHostPort(cfg.Listen.BindAddr, strconv.Itoa(cfg.TCP.Port))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// With port 0 the OS picks the port, so report the one we got.
+	port := listener.Addr().(*net.TCPAddr).Port
+	tcpPort = port
+	addr = listener.Addr().String()
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	log.Printf("TCP server started on %s (TLS: %t)", addr, tlsConfig != nil)
+	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP server started on port %d", port))
+
+	tcpConsole.serve(listener)
+	return nil
+}
+
+func (s *tcpServer) serve(listener net.Listener) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+
+	go s.accept(listener)
+}
+
+func (s *tcpServer) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error accepting TCP connection: %v", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+func (s *tcpServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections and interrupts every client's next
+// read. Commands already running are allowed to finish, after which each
+// client is sent a goodbye. When ctx ends first, the remaining executions
+// are cancelled and their connections closed.
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for client := range s.clients {
+		client.conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Cancelled scripts stop at their next instruction; give the clients a
+	// moment to hear about it before dropping them.
+	s.cancel()
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-time.After(tcpShutdownGrace):
+	}
+
+	s.mu.Lock()
+	for client := range s.clients {
+		client.conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-done
+	return ctx.Err()
+}
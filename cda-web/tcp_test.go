@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testServer struct {
+	once   sync.Once
+	tokens map[string]string
+}
+
+// setupTestServer installs the globals the TCP console and the HTTP handlers
+// use: an in-memory auth store holding admin, alice (an operator) and victor
+// (a viewer), the default sandbox and limits, a small scheduler and the
+// status reporters. It returns a login token for each of those accounts.
+func setupTestServer(t *testing.T) map[string]string {
+	t.Helper()
+
+	testServer.once.Do(func() {
+		cfg := DefaultConfig()
+		cfg.Auth.StoreFile = ""
+
+		wsManager = NewWebSocketManager(cfg.WebSocket)
+		authManager = NewAuthManager(cfg.Auth, NewMemoryStore())
+		tcpAuth = NewTCPAuthenticator(cfg.TCP, cfg.TLS)
+		sandbox = NewSandboxRegistry()
+		execLimits = NewLimitsRegistry()
+		scheduler = NewScheduler(4, 64, 16, 4)
+		luaSessions = NewLuaSessionManager(4, time.Hour)
+		jobManager = NewJobManager()
+		portManager = NewPortManager(cfg)
+		injectorStatus = NewInjectorStatus()
+		hwid = NewHWIDSpoofer()
+
+		testServer.tokens = make(map[string]string)
+		for username, role := range map[string]string{"admin": RoleAdmin, "alice": RoleOperator, "victor": RoleViewer} {
+			if err := authManager.store.PutUser(&User{Username: username, Role: role, CreatedAt: time.Now()}); err != nil {
+				panic(err)
+			}
+			token, _, err := authManager.createSession(username)
+			if err != nil {
+				panic(err)
+			}
+			testServer.tokens[username] = token
+		}
+	})
+
+	return testServer.tokens
+}
+
+// consoleConn is the client end of a console connection served over
+// net.Pipe. Everything the server writes is read as it arrives, since a pipe
+// write blocks until it is read.
+type consoleConn struct {
+	t        *testing.T
+	conn     net.Conn
+	received chan string
+	pending  string
+}
+
+func dialConsole(t *testing.T) *consoleConn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTCPServer().handleConnection(server)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	c := &consoleConn{t: t, conn: client, received: make(chan string, 64)}
+	go func() {
+		defer close(c.received)
+		buf := make([]byte, 4096)
+		for {
+			n, err := client.Read(buf)
+			if n > 0 {
+				c.received <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	c.expect("Send {\"type\":\"hello\"")
+	c.expect("\n")
+	return c
+}
+
+func (c *consoleConn) send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("sending %q: %v", line, err)
+	}
+}
+
+// read waits for more output, reporting false once the server has hung up.
+func (c *consoleConn) read() bool {
+	c.t.Helper()
+
+	select {
+	case data, ok := <-c.received:
+		if !ok {
+			return false
+		}
+		c.pending += data
+		return true
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out; got %q", c.pending)
+		return false
+	}
+}
+
+// expect reads until want has been received and returns everything read up
+// to and including it.
+func (c *consoleConn) expect(want string) string {
+	c.t.Helper()
+
+	for !strings.Contains(c.pending, want) {
+		if !c.read() {
+			c.t.Fatalf("connection closed waiting for %q; got %q", want, c.pending)
+		}
+	}
+
+	i := strings.Index(c.pending, want) + len(want)
+	got := c.pending[:i]
+	c.pending = c.pending[i:]
+	return got
+}
+
+// expectClosed checks that the server hangs up without saying more.
+func (c *consoleConn) expectClosed() {
+	c.t.Helper()
+
+	for c.read() {
+	}
+	if c.pending != "" {
+		c.t.Fatalf("unexpected output before the connection closed: %q", c.pending)
+	}
+}
+
+// frame reads the next JSON frame, skipping the text banner.
+func (c *consoleConn) frame() WireResponse {
+	c.t.Helper()
+
+	for {
+		line := strings.TrimSpace(c.expect("\n"))
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var resp WireResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			c.t.Fatalf("decoding frame %q: %v", line, err)
+		}
+		return resp
+	}
+}
+
+type consoleStep struct {
+	send string
+	want string
+}
+
+func runConsoleSteps(t *testing.T, tokens map[string]string, steps []consoleStep) *consoleConn {
+	t.Helper()
+
+	placeholders := make([]string, 0, 2*len(tokens))
+	for username, token := range tokens {
+		placeholders = append(placeholders, "{"+username+"}", token)
+	}
+	fill := strings.NewReplacer(placeholders...)
+
+	c := dialConsole(t)
+	for _, step := range steps {
+		c.send(fill.Replace(step.send))
+		c.expect(step.want)
+	}
+	return c
+}
+
+func TestConsoleTextMode(t *testing.T) {
+	tokens := setupTestServer(t)
+
+	tests := []struct {
+		name  string
+		steps []consoleStep
+	}{
+		{"exec needs auth", []consoleStep{
+			{"EXEC:return 1", "Error: authentication required"},
+		}},
+		{"bad credential", []consoleStep{
+			{"AUTH nonsense", "Error: " + ErrTCPAuthFailed.Error()},
+		}},
+		{"exec", []consoleStep{
+			{"AUTH {alice}", "OK: Authenticated as alice\n"},
+			{"EXEC:return 1 + 1", "Success: [2]\n"},
+			{"EXEC:print('hi')", "hi\nSuccess: Script executed successfully\n"},
+			{"EXEC:error('boom')", "Error: "},
+		}},
+		{"viewer may not exec", []consoleStep{
+			{"AUTH {victor}", "OK: Authenticated as victor\n"},
+			{"EXEC:return 1", "Error: role viewer may not run scripts\n"},
+			{":repl", "Error: role viewer may not run scripts\n"},
+		}},
+		{"check", []consoleStep{
+			{"AUTH {victor}", "OK: Authenticated as victor\n"},
+			{"CHECK:return 1", "OK: No syntax errors\n"},
+			{"CHECK:return (", "Error: "},
+		}},
+		{"echo and help", []consoleStep{
+			{"hello there", "Echo: hello there\n"},
+			{":help", ":reset"},
+		}},
+		{"frame that is not a hello", []consoleStep{
+			{`{"type":"exec","id":"1","script":"return 1"}`, `Echo: {"type":"exec"`},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runConsoleSteps(t, tokens, test.steps)
+		})
+	}
+
+	t.Run("quit", func(t *testing.T) {
+		c := runConsoleSteps(t, tokens, []consoleStep{{":quit", "Goodbye\n"}})
+		c.expectClosed()
+	})
+}
+
+func TestConsoleRepl(t *testing.T) {
+	tokens := setupTestServer(t)
+
+	tests := []struct {
+		name  string
+		steps []consoleStep
+	}{
+		{"expressions and globals", []consoleStep{
+			{"x = 41", replPrompt},
+			{"x + 1", "42\n" + replPrompt},
+			{"=x", "41\n" + replPrompt},
+			{"print('a', 'b')", "a\tb\n"},
+		}},
+		{"continuation", []consoleStep{
+			{"function f(n)", replContinue},
+			{"  return n * 2", replContinue},
+			{"end", replPrompt},
+			{"f(21)", "42\n" + replPrompt},
+		}},
+		{"reset abandons a chunk and the globals", []consoleStep{
+			{"x = 1", replPrompt},
+			{"if x then", replContinue},
+			{":reset", "Lua state reset\n" + replPrompt},
+			{"=x", "nil\n" + replPrompt},
+		}},
+		{"errors", []consoleStep{
+			{"error('boom')", "Error: "},
+			{"=1", "1\n" + replPrompt},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps := append([]consoleStep{
+				{"AUTH {alice}", "OK: Authenticated as alice\n"},
+				{":repl", "Type :help for commands.\n" + replPrompt},
+			}, test.steps...)
+			runConsoleSteps(t, tokens, steps)
+		})
+	}
+
+	t.Run("quit inside a chunk", func(t *testing.T) {
+		c := runConsoleSteps(t, tokens, []consoleStep{
+			{"AUTH {alice}", "OK: Authenticated as alice\n"},
+			{":repl", replPrompt},
+			{"for i = 1, 3 do", replContinue},
+			{":quit", "Goodbye\n"},
+		})
+		c.expectClosed()
+	})
+}
+
+// wireStep sends a frame and expects the given frames back, in any order.
+// Only the fields set in a wanted frame are compared, apart from Type.
+type wireStep struct {
+	send string
+	want []WireResponse
+}
+
+func frameMatches(got WireResponse, want WireResponse) bool {
+	if got.Type != want.Type || got.ID != want.ID || got.Code != want.Code {
+		return false
+	}
+	if want.User != "" && got.User != want.User {
+		return false
+	}
+	if want.Message != "" && got.Message != want.Message {
+		return false
+	}
+	if want.Line != nil && (got.Line == nil || got.Line.Text != want.Line.Text) {
+		return false
+	}
+	if want.Results != nil && !reflect.DeepEqual(got.Results, want.Results) {
+		return false
+	}
+	if want.Error != nil && (got.Error == nil || got.Error.Kind != want.Error.Kind) {
+		return false
+	}
+	if want.Diagnostics != nil && len(got.Diagnostics) != len(want.Diagnostics) {
+		return false
+	}
+	return true
+}
+
+func TestConsoleWireProtocol(t *testing.T) {
+	tokens := setupTestServer(t)
+	hello := `{"type":"hello","version":1,"token":"{alice}"}`
+	helloOK := WireResponse{Type: "ok", Version: wireProtocolVersion, User: "alice"}
+
+	tests := []struct {
+		name  string
+		steps []wireStep
+	}{
+		{"hello", []wireStep{
+			{`{"type":"hello","version":1}`, []WireResponse{{Type: "error", Code: wireCodeUnauthorized}}},
+			{`{"type":"hello","version":99,"token":"{alice}"}`, []WireResponse{{Type: "error", Code: wireCodeVersion}}},
+			{`{"type":"hello","version":1,"token":"nonsense"}`, []WireResponse{{Type: "error", Code: wireCodeUnauthorized}}},
+			{`{"type":"exec","id":"1","script":"return 1"}`, []WireResponse{{Type: "error", ID: "1", Code: wireCodeHandshake}}},
+			{hello, []WireResponse{helloOK}},
+			{hello, []WireResponse{{Type: "error", Code: wireCodeBadRequest}}},
+			{`{"type":"ping","id":"p"}`, []WireResponse{{Type: "ok", ID: "p", Message: "pong"}}},
+		}},
+		{"exec", []wireStep{
+			{hello, []WireResponse{helloOK}},
+			{`{"type":"exec","id":"1","script":"print('hi')\nreturn 1 + 1, 'x'"}`, []WireResponse{
+				{Type: "output", ID: "1", Line: &OutputLine{Text: "hi"}},
+				{Type: "done", ID: "1", Results: []interface{}{2.0, "x"}},
+			}},
+			{`{"type":"exec","id":"2","script":"error('boom')"}`, []WireResponse{
+				{Type: "error", ID: "2", Error: &ExecutionError{Kind: ErrCodeRuntime}},
+			}},
+			{`{"type":"exec","id":"3","script":"return os.time()"}`, []WireResponse{
+				{Type: "error", ID: "3", Error: &ExecutionError{Kind: ErrCodeSandboxViolation}},
+			}},
+			{`{"type":"exec","id":"4","script":"return 1","profile":"trusted"}`, []WireResponse{
+				{Type: "error", ID: "4", Code: wireCodeForbidden},
+			}},
+		}},
+		{"viewer may not exec", []wireStep{
+			{`{"type":"hello","version":1,"token":"{victor}"}`, []WireResponse{{Type: "ok", Version: wireProtocolVersion, User: "victor"}}},
+			{`{"type":"exec","id":"1","script":"return 1"}`, []WireResponse{{Type: "error", ID: "1", Code: wireCodeForbidden}}},
+		}},
+		{"cancel", []wireStep{
+			{hello, []WireResponse{helloOK}},
+			{`{"type":"cancel","id":"nothing"}`, []WireResponse{{Type: "error", ID: "nothing", Code: wireCodeNotFound}}},
+			{`{"type":"exec","id":"loop","script":"print('started') while true do end"}`, []WireResponse{
+				{Type: "output", ID: "loop", Line: &OutputLine{Text: "started"}},
+			}},
+			{`{"type":"cancel","id":"loop"}`, []WireResponse{
+				{Type: "ok", ID: "loop", Message: "Cancellation requested"},
+				{Type: "error", ID: "loop", Error: &ExecutionError{Kind: ErrCodeCancelled}},
+			}},
+		}},
+		{"check", []wireStep{
+			{hello, []WireResponse{helloOK}},
+			{`{"type":"check","id":"1","script":"return 1"}`, []WireResponse{{Type: "ok", ID: "1", Message: "No syntax errors"}}},
+			{`{"type":"check","id":"2","script":"return ("}`, []WireResponse{
+				{Type: "error", ID: "2", Error: &ExecutionError{Kind: ErrCodeSyntax}, Diagnostics: []*ExecutionError{{}}},
+			}},
+		}},
+		{"bad requests", []wireStep{
+			{hello, []WireResponse{helloOK}},
+			{`{"type":`, []WireResponse{{Type: "error", Code: wireCodeBadRequest}}},
+			{`{"type":"exec","script":"return 1"}`, []WireResponse{{Type: "error", Code: wireCodeBadRequest}}},
+			{`{"type":"launch","id":"1"}`, []WireResponse{{Type: "error", ID: "1", Code: wireCodeUnknownType}}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fill := strings.NewReplacer("{alice}", tokens["alice"], "{victor}", tokens["victor"])
+			c := dialConsole(t)
+
+			for _, step := range test.steps {
+				c.send(fill.Replace(step.send))
+
+				want := append([]WireResponse(nil), step.want...)
+				for len(want) > 0 {
+					got := c.frame()
+					matched := false
+					for i := range want {
+						if frameMatches(got, want[i]) {
+							want = append(want[:i], want[i+1:]...)
+							matched = true
+							break
+						}
+					}
+					if !matched {
+						t.Fatalf("after %s: unexpected frame %+v, still waiting for %+v", step.send, got, want)
+					}
+				}
+			}
+		})
+	}
+}
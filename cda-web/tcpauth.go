@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTCPAuthFailed = errors.New("invalid token or API key")
+	ErrTCPAuthLocked = errors.New("too many failed attempts, try again later")
+)
+
+type tcpAuthFailures struct {
+	count        int
+	first        time.Time
+	blockedUntil time.Time
+}
+
+// TCPAuthenticator checks the credentials presented on the TCP port. A
+// credential is either a login token or one of the configured API keys.
+// Failed attempts are counted per remote host; once maxFailures happen inside
+// window the host is locked out for lockout. Hosts whose window and lockout
+// have both passed are forgotten by sweep.
+type TCPAuthenticator struct {
+	apiKeys     map[string]string
+	apiKeyRoles map[string]string
+	certRoles   map[string]string
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	failures    map[string]*tcpAuthFailures
+	mu          sync.Mutex
+}
+
+func NewTCPAuthenticator(cfg TCPConfig, tlsCfg TLSSettings) *TCPAuthenticator {
+	ta := &TCPAuthenticator{
+		apiKeys:     make(map[string]string),
+		apiKeyRoles: cfg.APIKeyRoles,
+		certRoles:   tlsCfg.ClientRoles,
+		maxFailures: cfg.MaxAuthFailures,
+		window:      time.Minute,
+		lockout:     time.Duration(cfg.AuthLockout),
+		failures:    make(map[string]*tcpAuthFailures),
+	}
+
+	for username, key := range cfg.APIKeys {
+		ta.AddAPIKey(username, key)
+	}
+
+	go ta.sweep()
+
+	return ta
+}
+
+// AddAPIKey lets key authenticate as username. Only a digest of the key is
+// kept.
+func (ta *TCPAuthenticator) AddAPIKey(username string, key string) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.apiKeys[apiKeyDigest(key)] = username
+}
+
+// Authenticate resolves credential for the client at addr, counting the
+// attempt against the host if it fails. When credential is a login token the
+// hash of its session is returned too, so the connection can be checked
+// again with Reauthenticate.
+func (ta *TCPAuthenticator) Authenticate(addr string, credential string) (*User, string, error) {
+	host := remoteHost(addr)
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	now := time.Now()
+	entry := ta.failures[host]
+	if entry != nil && now.Before(entry.blockedUntil) {
+		return nil, "", ErrTCPAuthLocked
+	}
+
+	if user, tokenHash := ta.lookupLocked(credential); user != nil {
+		delete(ta.failures, host)
+		return user, tokenHash, nil
+	}
+
+	if entry == nil || now.Sub(entry.first) > ta.window {
+		entry = &tcpAuthFailures{first: now}
+		ta.failures[host] = entry
+	}
+	entry.count++
+
+	if entry.count >= ta.maxFailures {
+		entry.blockedUntil = now.Add(ta.lockout)
+		log.Printf("TCP authentication locked for %s after %d failed attempts", host, entry.count)
+		wsManager.BroadcastMessage("[Security] TCP authentication locked for " + host)
+	}
+
+	return nil, "", ErrTCPAuthFailed
+}
+
+func (ta *TCPAuthenticator) lookupLocked(credential string) (*User, string) {
+	if credential == "" {
+		return nil, ""
+	}
+
+	if session := authManager.session(credential); session != nil {
+		if user := authManager.GetUser(session.UserID); user != nil {
+			return user, session.TokenHash
+		}
+	}
+
+	username, exists := ta.apiKeys[apiKeyDigest(credential)]
+	if !exists {
+		return nil, ""
+	}
+
+	return configuredUser(username, ta.apiKeyRoles[username]), ""
+}
+
+// CertificateUser returns the user a verified client certificate with the
+// common name name signs in as.
+func (ta *TCPAuthenticator) CertificateUser(name string) *User {
+	return configuredUser(name, ta.certRoles[name])
+}
+
+// Reauthenticate looks up again the user a connection signed in as, so a
+// logout, a revoked session or a role change reaches connections that are
+// already open. tokenHash is the one Authenticate returned; without one the
+// user came from an API key or client certificate and is looked up by name,
+// keeping the role it was configured with if it has no account. It returns
+// nil once the session has ended.
+func (ta *TCPAuthenticator) Reauthenticate(user *User, tokenHash string) *User {
+	if tokenHash == "" {
+		return configuredUser(user.Username, user.Role)
+	}
+
+	session := authManager.sessionByHash(tokenHash)
+	if session == nil {
+		return nil
+	}
+	return authManager.GetUser(session.UserID)
+}
+
+// configuredUser returns the account an API key or client certificate names.
+// These may name accounts that were never registered over HTTP; those get
+// role, the one configured for the key or certificate, and are viewers if
+// none was.
+func configuredUser(username string, role string) *User {
+	if user := authManager.GetUser(username); user != nil {
+		return user
+	}
+	if role == "" {
+		role = RoleViewer
+	}
+	return &User{Username: username, Role: role}
+}
+
+func (ta *TCPAuthenticator) sweep() {
+	ticker := time.NewTicker(ta.window)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ta.pruneFailures(time.Now())
+	}
+}
+
+// pruneFailures forgets the hosts that no longer count as failing at now.
+func (ta *TCPAuthenticator) pruneFailures(now time.Time) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	for host, entry := range ta.failures {
+		if now.Sub(entry.first) > ta.window && !now.Before(entry.blockedUntil) {
+			delete(ta.failures, host)
+		}
+	}
+}
+
+func apiKeyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneFailuresForgetsIdleHosts(t *testing.T) {
+	ta := NewTCPAuthenticator(TCPConfig{MaxAuthFailures: 3, AuthLockout: Duration(time.Hour)}, TLSSettings{})
+	now := time.Now()
+
+	ta.failures["recent"] = &tcpAuthFailures{count: 1, first: now.Add(-time.Second)}
+	ta.failures["idle"] = &tcpAuthFailures{count: 2, first: now.Add(-2 * time.Minute)}
+	ta.failures["locked"] = &tcpAuthFailures{count: 3, first: now.Add(-2 * time.Minute), blockedUntil: now.Add(time.Minute)}
+	ta.failures["unlocked"] = &tcpAuthFailures{count: 3, first: now.Add(-time.Hour), blockedUntil: now.Add(-time.Minute)}
+
+	ta.pruneFailures(now)
+
+	for host, want := range map[string]bool{"recent": true, "idle": false, "locked": true, "unlocked": false} {
+		if _, kept := ta.failures[host]; kept != want {
+			t.Errorf("%s kept = %v, want %v", host, kept, want)
+		}
+	}
+}
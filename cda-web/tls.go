@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// TLSSettings selects how the listeners are secured. With neither a
+// certificate nor SelfSigned everything stays plaintext. ClientCAFile turns
+// on client-certificate authentication for the TCP port only; ClientRoles
+// maps a certificate's common name to the role it signs in with, viewer if
+// it is not listed.
+type TLSSettings struct {
+	CertFile     string            `json:"certFile,omitempty"`
+	KeyFile      string            `json:"keyFile,omitempty"`
+	SelfSigned   bool              `json:"selfSigned,omitempty"`
+	ClientCAFile string            `json:"clientCAFile,omitempty"`
+	ClientRoles  map[string]string `json:"clientRoles,omitempty"`
+}
+
+func (s TLSSettings) Enabled() bool {
+	return s.CertFile != "" || s.SelfSigned
+}
+
+// ServerConfig builds the configuration shared by the HTTP server and /ws.
+// It returns nil when TLS is disabled.
+func (s TLSSettings) ServerConfig() (*tls.Config, error) {
+	if !s.Enabled() {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+
+	if s.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	} else {
+		cert, err = generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		log.Printf("Using a self-signed TLS certificate (SHA-256 %s)", certFingerprint(cert))
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TCPConfig derives the TCP listener's configuration from the server one,
+// adding client-certificate verification when a client CA is configured.
+// Certificates are optional so token and API key logins keep working.
+func (s TLSSettings) TCPConfig(server *tls.Config) (*tls.Config, error) {
+	if server == nil {
+		if s.ClientCAFile != "" {
+			return nil, fmt.Errorf("client certificates require a TLS certificate or tls.selfSigned")
+		}
+		return nil, nil
+	}
+
+	config := server.Clone()
+	if s.ClientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(s.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", s.ClientCAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// generateSelfSignedCert creates a throwaway certificate for localhost, for
+// development only. Browsers have to be told to trust it once.
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Canda executor (development)"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+func certFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertUser returns the user a verified client certificate speaks for,
+// taken from its common name, or nil if the connection presented none.
+func clientCertUser(conn net.Conn) (*User, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, nil
+	}
+
+	name := chains[0][0].Subject.CommonName
+	if name == "" {
+		return nil, fmt.Errorf("client certificate has no common name")
+	}
+
+	// A certificate from the configured CA is as good as an API key.
+	return tcpAuth.CertificateUser(name), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
@@ -17,28 +18,41 @@ type Client struct {
 	connected bool
 }
 
+type ErrorEvent struct {
+	Type  string          `json:"type"`
+	JobID string          `json:"jobId,omitempty"`
+	Error *ExecutionError `json:"error"`
+}
+
 type WebSocketManager struct {
 	clients    map[*Client]bool
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan []byte
+	closing    bool
+	pumps      sync.WaitGroup
 	mu         sync.Mutex
 	upgrader   websocket.Upgrader
+	config     WebSocketConfig
 }
 
-func NewWebSocketManager() *WebSocketManager {
+func NewWebSocketManager(cfg WebSocketConfig) *WebSocketManager {
 	manager := &WebSocketManager{
 		clients:    make(map[*Client]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan []byte),
 		upgrader: websocket.Upgrader{
+			// The console is served from a different origin than the API,
+			// and the token a connection must present is not something a
+			// browser attaches on its own, so any origin may connect.
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.WriteBufferSize,
 		},
+		config: cfg,
 	}
 
 	go manager.run()
@@ -50,6 +64,11 @@ func (manager *WebSocketManager) run() {
 		select {
 		case client := <-manager.register:
 			manager.mu.Lock()
+			if manager.closing {
+				close(client.send)
+				manager.mu.Unlock()
+				continue
+			}
 			manager.clients[client] = true
 			manager.mu.Unlock()
 			log.Printf("Client connected: %s", client.conn.RemoteAddr())
@@ -93,21 +112,77 @@ func (manager *WebSocketManager) HandleWebSocket(w http.ResponseWriter, r *http.
 
 	client := &Client{
 		conn:      conn,
-		send:      make(chan []byte, 256),
+		send:      make(chan []byte, manager.config.SendQueueSize),
 		manager:   manager,
 		connected: true,
 	}
 
+	// Counted under the lock Close takes, so a shutdown either waits for
+	// this client's pumps or has already begun and turns it away.
+	manager.mu.Lock()
+	if manager.closing {
+		manager.mu.Unlock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Duration(manager.config.WriteTimeout)))
+		conn.Close()
+		return
+	}
+	manager.pumps.Add(1)
+	manager.mu.Unlock()
+
 	manager.register <- client
 
 	go client.readPump()
 	go client.writePump()
 }
 
+// Close says goodbye to every client: closing a client's send channel makes
+// its writePump flush what is queued and send a close frame. Every write has
+// a deadline, so waiting for the pumps is bounded. Broadcasts after Close
+// are dropped.
+func (manager *WebSocketManager) Close() {
+	manager.mu.Lock()
+	manager.closing = true
+	for client := range manager.clients {
+		delete(manager.clients, client)
+		close(client.send)
+	}
+	manager.mu.Unlock()
+
+	manager.pumps.Wait()
+}
+
+func (manager *WebSocketManager) isClosing() bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return manager.closing
+}
+
 func (manager *WebSocketManager) BroadcastMessage(message string) {
 	manager.broadcast <- []byte(message)
 }
 
+func (manager *WebSocketManager) BroadcastJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding broadcast: %v", err)
+		return
+	}
+	manager.broadcast <- data
+}
+
+func (manager *WebSocketManager) BroadcastError(jobID string, execErr *ExecutionError) {
+	if execErr == nil {
+		return
+	}
+	manager.BroadcastJSON(ErrorEvent{
+		Type:  "error",
+		JobID: jobID,
+		Error: execErr,
+	})
+}
+
 func (manager *WebSocketManager) GetClientCount() int {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
@@ -123,10 +198,11 @@ func (client *Client) readPump() {
 		client.mu.Unlock()
 	}()
 
-	client.conn.SetReadLimit(512 * 1024)
-	client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	cfg := client.manager.config
+	client.conn.SetReadLimit(cfg.MaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(time.Duration(cfg.PongTimeout)))
 	client.conn.SetPongHandler(func(string) error {
-		client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		client.conn.SetReadDeadline(time.Now().Add(time.Duration(cfg.PongTimeout)))
 		return nil
 	})
 
@@ -142,18 +218,24 @@ func (client *Client) readPump() {
 }
 
 func (client *Client) writePump() {
-	ticker := time.NewTicker(30 * time.Second)
+	cfg := client.manager.config
+	ticker := time.NewTicker(time.Duration(cfg.PingInterval))
 	defer func() {
 		ticker.Stop()
 		client.conn.Close()
+		client.manager.pumps.Done()
 	}()
 
 	for {
 		select {
 		case message, ok := <-client.send:
-			client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			client.conn.SetWriteDeadline(time.Now().Add(time.Duration(cfg.WriteTimeout)))
 			if !ok {
-				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				message := []byte{}
+				if client.manager.isClosing() {
+					message = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				}
+				client.conn.WriteMessage(websocket.CloseMessage, message)
 				return
 			}
 
@@ -173,7 +255,7 @@ func (client *Client) writePump() {
 				return
 			}
 		case <-ticker.C:
-			client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			client.conn.SetWriteDeadline(time.Now().Add(time.Duration(cfg.WriteTimeout)))
 			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// The framed protocol on the TCP port is newline-delimited JSON: every
+// request and response is one JSON object on one line, so scripts containing
+// newlines travel inside the "script" string. A connection whose first frame
+// is a hello speaks this protocol; anything else is served by the legacy
+// EXEC:/Echo text mode. The hello must carry a token or API key unless a
+// client certificate was presented, and nothing else is accepted until it
+// succeeds. The text banner sent on connect precedes the hello
+// reply, so clients skip lines until they read a JSON object.
+//
+// Every execution answers with zero or more "output" frames followed by
+// exactly one "done" or "error" frame carrying the request's id. Protocol
+// problems are reported as "error" frames with a code; script failures carry
+// the structured ExecutionError instead. When the executor shuts down it
+// lets running executions finish and then sends a final "bye" frame.
+const wireProtocolVersion = 1
+
+const (
+	wireCodeBadRequest   = "bad_request"
+	wireCodeHandshake    = "handshake_required"
+	wireCodeVersion      = "unsupported_version"
+	wireCodeUnauthorized = "unauthorized"
+	wireCodeRateLimited  = "rate_limited"
+	wireCodeForbidden    = "forbidden"
+	wireCodeBusy         = "busy"
+	wireCodeDuplicateID  = "duplicate_id"
+	wireCodeNotFound     = "not_found"
+	wireCodeUnknownType  = "unknown_type"
+	wireCodeShuttingDown = "shutting_down"
+)
+
+type WireRequest struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	Token     string `json:"token,omitempty"`
+	APIKey    string `json:"apiKey,omitempty"`
+	Script    string `json:"script,omitempty"`
+	Profile   string `json:"profile,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	Broadcast bool   `json:"broadcast,omitempty"`
+}
+
+type WireResponse struct {
+	Type        string            `json:"type"`
+	ID          string            `json:"id,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Code        string            `json:"code,omitempty"`
+	RetryAfter  int               `json:"retryAfter,omitempty"`
+	Line        *OutputLine       `json:"line,omitempty"`
+	Results     []interface{}     `json:"results,omitempty"`
+	Truncated   bool              `json:"truncated,omitempty"`
+	PeakMemory  int64             `json:"peakMemory,omitempty"`
+	Error       *ExecutionError   `json:"error,omitempty"`
+	Diagnostics []*ExecutionError `json:"diagnostics,omitempty"`
+}
+
+// wireConn is the state of a TCP connection that negotiated the framed
+// protocol. Executions run concurrently, so writes are serialised.
+type wireConn struct {
+	client     *tcpClient
+	negotiated bool
+	inflight   map[string]context.CancelFunc
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+}
+
+// parseHello reports whether line is a hello frame, which is how a client
+// opts out of the legacy text mode.
+func parseHello(line string) (WireRequest, bool) {
+	var req WireRequest
+	if !strings.HasPrefix(line, "{") {
+		return req, false
+	}
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		return req, false
+	}
+	return req, req.Type == "hello"
+}
+
+func (c *tcpClient) runWire(hello WireRequest) {
+	wc := &wireConn{
+		client:   c,
+		inflight: make(map[string]context.CancelFunc),
+	}
+	c.wire = wc
+	defer wc.shutdown()
+
+	wc.handle(hello)
+
+	for {
+		line, ok := c.readLine()
+		if !ok {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var req WireRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			wc.sendError("", wireCodeBadRequest, "invalid frame: "+err.Error())
+			continue
+		}
+
+		if !wc.handle(req) {
+			return
+		}
+	}
+}
+
+func (wc *wireConn) send(resp WireResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error encoding TCP frame: %v", err)
+		return
+	}
+
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+	wc.client.conn.Write(append(data, '\n'))
+}
+
+func (wc *wireConn) sendError(id string, code string, message string) {
+	wc.send(WireResponse{Type: "error", ID: id, Code: code, Message: message})
+}
+
+// handle serves one frame. It returns false when the connection must be
+// closed because the user's session or role no longer allows it to run
+// scripts.
+func (wc *wireConn) handle(req WireRequest) bool {
+	if req.Type == "hello" {
+		wc.hello(req)
+		return true
+	}
+
+	if !wc.negotiated {
+		wc.sendError(req.ID, wireCodeHandshake, "send a hello frame first")
+		return true
+	}
+
+	switch req.Type {
+	case "exec":
+		if err := wc.client.reauthorize(); err != nil {
+			wc.sendError(req.ID, wireCodeUnauthorized, err.Error())
+			return false
+		}
+		wc.exec(req)
+	case "check":
+		wc.check(req)
+	case "cancel":
+		wc.cancel(req)
+	case "ping":
+		wc.send(WireResponse{Type: "ok", ID: req.ID, Message: "pong"})
+	default:
+		wc.sendError(req.ID, wireCodeUnknownType, fmt.Sprintf("unknown frame type: %q", req.Type))
+	}
+	return true
+}
+
+func (wc *wireConn) hello(req WireRequest) {
+	if wc.negotiated {
+		wc.sendError(req.ID, wireCodeBadRequest, "handshake already completed")
+		return
+	}
+
+	if req.Version < 1 || req.Version > wireProtocolVersion {
+		wc.send(WireResponse{
+			Type:    "error",
+			ID:      req.ID,
+			Code:    wireCodeVersion,
+			Version: wireProtocolVersion,
+			Message: fmt.Sprintf("unsupported protocol version %d", req.Version),
+		})
+		return
+	}
+
+	credential := req.Token
+	if credential == "" {
+		credential = req.APIKey
+	}
+	if credential == "" && wc.client.user == nil {
+		wc.sendError(req.ID, wireCodeUnauthorized, "hello requires a token or apiKey")
+		return
+	}
+
+	// A verified client certificate already identified the caller.
+	user := wc.client.user
+	tokenHash := ""
+	var err error
+	if credential != "" {
+		user, tokenHash, err = tcpAuth.Authenticate(wc.client.addr, credential)
+	}
+	if err == ErrTCPAuthLocked {
+		wc.sendError(req.ID, wireCodeRateLimited, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("TCP authentication failed for %s: %v", wc.client.addr, err)
+		wc.sendError(req.ID, wireCodeUnauthorized, err.Error())
+		return
+	}
+
+	wc.client.user = user
+	wc.client.tokenHash = tokenHash
+	wc.negotiated = true
+
+	log.Printf("TCP client %s authenticated as %s, protocol version %d", wc.client.addr, user.Username, wireProtocolVersion)
+	wsManager.BroadcastMessage(fmt.Sprintf("[System] TCP client %s authenticated as %s", wc.client.addr, user.Username))
+
+	wc.send(WireResponse{
+		Type:    "ok",
+		ID:      req.ID,
+		Version: wireProtocolVersion,
+		User:    user.Username,
+		Message: "Canda executor",
+	})
+}
+
+func (wc *wireConn) exec(req WireRequest) {
+	if req.ID == "" {
+		wc.sendError("", wireCodeBadRequest, "exec requires an id")
+		return
+	}
+
+	user := wc.client.user
+	if !user.CanExecute() {
+		wc.sendError(req.ID, wireCodeForbidden, fmt.Sprintf("role %s may not run scripts", user.Role))
+		return
+	}
+
+	opts, err := resolveExecOptions(user, ExecuteRequest{
+		Script:    req.Script,
+		Profile:   req.Profile,
+		SessionID: req.SessionID,
+		Broadcast: req.Broadcast,
+	})
+	if err != nil {
+		wc.sendError(req.ID, wireCodeForbidden, err.Error())
+		return
+	}
+	opts.Source = wc.client.label()
+	opts.OnOutput = func(line OutputLine) {
+		wc.send(WireResponse{Type: "output", ID: req.ID, Line: &line})
+	}
+
+	ctx, cancel := context.WithCancel(wc.client.ctx)
+
+	wc.mu.Lock()
+	if _, exists := wc.inflight[req.ID]; exists {
+		wc.mu.Unlock()
+		cancel()
+		wc.sendError(req.ID, wireCodeDuplicateID, "a request with this id is still running")
+		return
+	}
+	wc.inflight[req.ID] = cancel
+	wc.wg.Add(1)
+	wc.mu.Unlock()
+
+	log.Printf("TCP execution %s by %s (%s)", req.ID, user.Username, wc.client.addr)
+	if opts.Broadcast {
+		wsManager.BroadcastMessage(fmt.Sprintf("[%s] Executing request %s", wc.client.label(), req.ID))
+	}
+
+	go func() {
+		defer wc.wg.Done()
+
+		var result *ExecResult
+		var err error
+		schedErr := scheduler.Run(ctx, user.Username, opts.sessionID(), func() {
+			result, err = executeLuaScript(ctx, req.Script, opts)
+		})
+		wc.finish(req.ID)
+
+		if schedErr == ErrSchedulerBusy {
+			wc.send(WireResponse{
+				Type:       "error",
+				ID:         req.ID,
+				Code:       wireCodeBusy,
+				Message:    schedErr.Error(),
+				RetryAfter: schedulerRetryAfter,
+			})
+			return
+		}
+		if schedErr == ErrShuttingDown {
+			wc.sendError(req.ID, wireCodeShuttingDown, schedErr.Error())
+			return
+		}
+		if schedErr != nil {
+			wc.send(WireResponse{
+				Type:    "error",
+				ID:      req.ID,
+				Message: "script was cancelled",
+				Error:   &ExecutionError{Kind: ErrCodeCancelled, Message: "script was cancelled"},
+			})
+			return
+		}
+
+		if err != nil {
+			resp := WireResponse{
+				Type:       "error",
+				ID:         req.ID,
+				Message:    err.Error(),
+				Truncated:  result.Truncated,
+				PeakMemory: result.PeakMemory,
+			}
+			var execErr *ExecutionError
+			if errors.As(err, &execErr) {
+				resp.Error = execErr
+			}
+			if opts.Broadcast {
+				wsManager.BroadcastError("", execErr)
+			}
+			wc.send(resp)
+			return
+		}
+
+		wc.send(WireResponse{
+			Type:       "done",
+			ID:         req.ID,
+			Results:    result.Results,
+			Truncated:  result.Truncated,
+			PeakMemory: result.PeakMemory,
+		})
+	}()
+}
+
+func (wc *wireConn) finish(id string) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if cancel, exists := wc.inflight[id]; exists {
+		cancel()
+		delete(wc.inflight, id)
+	}
+}
+
+func (wc *wireConn) check(req WireRequest) {
+	diagnostics := validateLuaScript(req.Script, defaultChunkName)
+	if len(diagnostics) == 0 {
+		wc.send(WireResponse{Type: "ok", ID: req.ID, Message: "No syntax errors"})
+		return
+	}
+
+	wc.send(WireResponse{
+		Type:        "error",
+		ID:          req.ID,
+		Message:     diagnostics[0].Error(),
+		Error:       diagnostics[0],
+		Diagnostics: diagnostics,
+	})
+}
+
+func (wc *wireConn) cancel(req WireRequest) {
+	wc.mu.Lock()
+	cancel, exists := wc.inflight[req.ID]
+	wc.mu.Unlock()
+
+	if !exists {
+		wc.sendError(req.ID, wireCodeNotFound, "no running request with this id")
+		return
+	}
+
+	cancel()
+	wc.send(WireResponse{Type: "ok", ID: req.ID, Message: "Cancellation requested"})
+}
+
+// shutdown cancels whatever is still running when the connection goes away
+// and waits for it, so nothing writes to a closed connection. When the server
+// is shutting down instead, executions are left to finish; the server cancels
+// them if its deadline passes.
+func (wc *wireConn) shutdown() {
+	if !wc.client.server.isClosing() {
+		wc.mu.Lock()
+		for _, cancel := range wc.inflight {
+			cancel()
+		}
+		wc.mu.Unlock()
+	}
+
+	wc.wg.Wait()
+}